@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/haxii/socks5"
+)
+
+// aclRule is a single rule from the -acl file
+type aclRule struct {
+	allow  bool
+	any    bool       // matches every destination
+	cidr   *net.IPNet // matches resolved destination IPs
+	domain string     // matches requested names
+	ports  portRange  // zero value matches every port
+}
+
+// acl is an ordered list of rules, the first matching rule decides
+type acl struct {
+	rules []aclRule
+}
+
+// currentACL holds the *acl in use, swapped when the file is reloaded
+var currentACL atomic.Value
+
+// loadACL parses the ACL file at path
+// each non-empty line not starting with # has the form: allow|deny CIDR|IP|DOMAIN|* [PORT[-PORT]]
+func loadACL(path string) (*acl, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &acl{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseACLRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, scanner.Err()
+}
+
+// parseACLRule parses the fields of a single ACL line
+func parseACLRule(fields []string) (aclRule, error) {
+	var rule aclRule
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, fmt.Errorf("expected \"allow|deny DESTINATION [PORTS]\", got %q", strings.Join(fields, " "))
+	}
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("unknown action %q", fields[0])
+	}
+	dest := fields[1]
+	if dest == "*" {
+		rule.any = true
+	} else if _, cidr, err := net.ParseCIDR(dest); err == nil {
+		rule.cidr = cidr
+	} else if ip := net.ParseIP(dest); ip != nil {
+		rule.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	} else {
+		rule.domain = dest
+	}
+	if len(fields) == 3 {
+		if err := rule.ports.Set(fields[2]); err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+// match returns true if the rule applies to addr
+func (r *aclRule) match(addr *socks5.AddrSpec) bool {
+	if r.ports.max != 0 && (addr.Port < int(r.ports.min) || addr.Port > int(r.ports.max)) {
+		return false
+	}
+	switch {
+	case r.any:
+		return true
+	case r.cidr != nil:
+		return addr.IP != nil && r.cidr.Contains(addr.IP)
+	default:
+		return addr.FQDN != "" && matchDomain(r.domain, addr.FQDN)
+	}
+}
+
+// check returns the first rule matching addr, nil if no rule applies
+func (a *acl) check(addr *socks5.AddrSpec) *aclRule {
+	for i := range a.rules {
+		if a.rules[i].match(addr) {
+			return &a.rules[i]
+		}
+	}
+	return nil
+}
+
+// aclCheck checks addr against the loaded ACL, matching nothing if none is loaded
+func aclCheck(addr *socks5.AddrSpec) *aclRule {
+	a, ok := currentACL.Load().(*acl)
+	if !ok {
+		return nil
+	}
+	return a.check(addr)
+}
+
+// initACL loads the -acl file and reloads it whenever SIGHUP is received
+func initACL() error {
+	if *aclFile == "" {
+		return nil
+	}
+	a, err := loadACL(*aclFile)
+	if err != nil {
+		return err
+	}
+	currentACL.Store(a)
+	l.Printf("loaded %d ACL rules from %s", len(a.rules), *aclFile)
+
+	onReload("ACL", func() error {
+		// on error the previous rules are kept rather than failing open
+		a, err := loadACL(*aclFile)
+		if err != nil {
+			return err
+		}
+		currentACL.Store(a)
+		l.Printf("reloaded %d ACL rules from %s", len(a.rules), *aclFile)
+		return nil
+	})
+	return nil
+}
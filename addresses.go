@@ -1,15 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"math"
 	"math/big"
 	"math/rand"
 	"net"
 )
 
-// possible enhancement
-// dial from iface: https://gist.github.com/creack/43ee6542ddc6fe0da8c02bd723d5cc53
-
 // from: https://gist.github.com/kotakanbe/d3059af990252ba89a82
 func hosts(cidr *net.IPNet) ([]net.IP, error) {
 	ips := make([]net.IP, 0, maskSize64(&cidr.Mask))
@@ -66,12 +64,12 @@ func maskSize(m *net.IPMask) big.Int {
 	return size
 }
 
-// randomIP returns a random IP address within the IPNet
+// randomIP returns a new random IP address within the IPNet
 func randomIP(cidr *net.IPNet) net.IP {
-	ip := cidr.IP
+	ip := make(net.IP, len(cidr.IP))
 	for i := range ip {
 		rb := byte(rand.Intn(math.MaxUint8))
-		ip[i] = (cidr.Mask[i] & ip[i]) + (^cidr.Mask[i] & rb)
+		ip[i] = (cidr.Mask[i] & cidr.IP[i]) + (^cidr.Mask[i] & rb)
 	}
 	return ip
 }
@@ -83,3 +81,119 @@ func getIPNetwork(ip *net.IP) string {
 	}
 	return "ip6"
 }
+
+// localAddrsIn returns the addresses assigned to local interfaces that are within cidr
+func localAddrsIn(cidr *net.IPNet) ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && cidr.Contains(ipNet.IP) {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// autoCIDR picks an egress subnet from the addresses assigned to the named interface
+// global IPv6 prefixes, including those learned from router advertisements, are preferred with the largest first
+// IPv4 falls back to the single assigned address as the rest of its subnet usually belongs to other hosts
+func autoCIDR(name string) (*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var best6, best4 *net.IPNet
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || isPrivate(ipNet.IP) {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if best4 == nil {
+				best4 = &net.IPNet{IP: ipNet.IP.To4(), Mask: net.CIDRMask(32, 32)}
+			}
+			continue
+		}
+		ones, _ := ipNet.Mask.Size()
+		if best6 == nil || ones < maskOnes(best6.Mask) {
+			best6 = &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+		}
+	}
+	if best6 != nil {
+		return best6, nil
+	}
+	if best4 != nil {
+		return best4, nil
+	}
+	return nil, fmt.Errorf("no global addresses found on %s", name)
+}
+
+// maskOnes returns the number of leading ones in m
+func maskOnes(m net.IPMask) int {
+	ones, _ := m.Size()
+	return ones
+}
+
+// interfaceIPs returns the global unicast addresses assigned to the named interface
+func interfaceIPs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no global addresses found on %s", name)
+	}
+	return ips, nil
+}
+
+// hostNets returns a single address network for each of ips
+func hostNets(ips []net.IP) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		bits := len(ip) * 8
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets
+}
+
+// listNetwork returns the network string covering every IP in ips
+func listNetwork(ips []net.IP) string {
+	network := getIPNetwork(&ips[0])
+	for i := range ips[1:] {
+		if getIPNetwork(&ips[i+1]) != network {
+			return "ip"
+		}
+	}
+	return network
+}
+
+// pickFamily returns a random IP from ips of the same family as dest, or from all of ips if there is none
+func pickFamily(ips []net.IP, dest net.IP) net.IP {
+	same := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (dest.To4() != nil) {
+			same = append(same, ip)
+		}
+	}
+	if len(same) == 0 {
+		same = ips
+	}
+	return same[rand.Intn(len(same))]
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// runAdmin serves the admin API on listenAddr
+func runAdmin(listenAddr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/", handleDashboard)
+	l.Printf("Starting admin API %s\n", listenAddr)
+	return http.ListenAndServe(listenAddr, mux)
+}
+
+// statsOrder are the orders /stats can sort by, largest first
+var statsOrder = map[string]func(a, b *egressStats) bool{
+	"bytes":       func(a, b *egressStats) bool { return a.BytesUp+a.BytesDown > b.BytesUp+b.BytesDown },
+	"bytes_up":    func(a, b *egressStats) bool { return a.BytesUp > b.BytesUp },
+	"bytes_down":  func(a, b *egressStats) bool { return a.BytesDown > b.BytesDown },
+	"active":      func(a, b *egressStats) bool { return a.Active > b.Active },
+	"connections": func(a, b *egressStats) bool { return a.Connections > b.Connections },
+	"failures":    func(a, b *egressStats) bool { return a.Failures > b.Failures },
+	"last_used":   func(a, b *egressStats) bool { return a.LastUsed.After(b.LastUsed) },
+}
+
+// handleStats returns the per egress statistics as JSON
+// the query may set sort to one of statsOrder (default bytes), top to return only the first N, and prefix4 and
+// prefix6 to sum addresses per prefix of that length
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	order := query.Get("sort")
+	if order == "" {
+		order = "bytes"
+	}
+	less, ok := statsOrder[order]
+	if !ok {
+		http.Error(w, "unknown sort "+strconv.Quote(order), http.StatusBadRequest)
+		return
+	}
+	top, err := queryInt(query.Get("top"), 0, 1<<31-1, 0)
+	if err != nil {
+		http.Error(w, "invalid top: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bits4, err := queryInt(query.Get("prefix4"), 0, 32, 32)
+	if err != nil {
+		http.Error(w, "invalid prefix4: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bits6, err := queryInt(query.Get("prefix6"), 0, 128, 128)
+	if err != nil {
+		http.Error(w, "invalid prefix6: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	all := snapshotEgressStats()
+	if bits4 != 32 || bits6 != 128 {
+		all = groupEgressStats(all, bits4, bits6)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return less(&all[i], &all[j])
+	})
+	if top > 0 && top < len(all) {
+		all = all[:top]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(all)
+}
+
+// queryInt parses an integer query parameter between min and max, returning def if it is empty
+func queryInt(s string, min, max, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || n > max {
+		return 0, strconv.ErrRange
+	}
+	return n, nil
+}
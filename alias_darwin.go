@@ -0,0 +1,42 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// addAliases assigns ips to iface as aliases and removes them again on exit
+func addAliases(iface string, ips []net.IP) error {
+	l.Printf("adding %d aliases to %s", len(ips), iface)
+	for _, ip := range ips {
+		if err := ifconfigAlias(iface, ip, "alias"); err != nil {
+			return err
+		}
+		ip := ip
+		onExit(func() {
+			if err := ifconfigAlias(iface, ip, "-alias"); err != nil {
+				errorf("%s", err)
+			}
+		})
+	}
+	return nil
+}
+
+// ifconfigAlias adds or removes ip as an alias on iface depending on op
+func ifconfigAlias(iface string, ip net.IP, op string) error {
+	var args []string
+	if ip.To4() != nil {
+		args = []string{iface, "inet", ip.String() + "/32", op}
+	} else {
+		args = []string{iface, "inet6", ip.String(), "prefixlen", "128", op}
+	}
+	out, err := exec.Command("ifconfig", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ifconfig %v: %w: %s", args, err, out)
+	}
+	return nil
+}
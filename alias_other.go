@@ -0,0 +1,14 @@
+//go:build !darwin
+// +build !darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// addAliases is not supported on this platform
+func addAliases(iface string, ips []net.IP) error {
+	return errors.New("-alias-iface is only supported on darwin")
+}
@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// arpLen is the length of an ethernet frame holding an IPv4 over ethernet ARP packet
+const arpLen = ethHeaderLen + 28
+
+// runARPProxy answers ARP requests received on iface for any address in cidr with the
+// interface's MAC address, so upstream gear that expects the prefix to be on-link delivers its traffic here
+func runARPProxy(iface string, cidr *net.IPNet) error {
+	if cidr.IP.To4() == nil {
+		return errors.New("-arp-proxy requires an IPv4 subnet")
+	}
+	conn, err := listenPacket(iface, syscall.ETH_P_ARP, false)
+	if err != nil {
+		return err
+	}
+	l.Printf("answering ARP requests for %s on %s", cidr.String(), iface)
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.read(buf)
+		if err != nil {
+			return err
+		}
+		frame := buf[:n]
+		if len(frame) < arpLen {
+			continue
+		}
+		arp := frame[ethHeaderLen:arpLen]
+		if binary.BigEndian.Uint16(arp[0:2]) != 1 || // ethernet
+			binary.BigEndian.Uint16(arp[2:4]) != syscall.ETH_P_IP ||
+			arp[4] != 6 || arp[5] != 4 ||
+			binary.BigEndian.Uint16(arp[6:8]) != 1 { // request
+			continue
+		}
+		senderMAC := net.HardwareAddr(arp[8:14])
+		sender := net.IP(arp[14:18])
+		target := net.IP(arp[24:28])
+		if sender.Equal(net.IPv4zero) || !cidr.Contains(target) {
+			// address conflict probe or not ours
+			continue
+		}
+		v("answering ARP request from %s for %s", sender.String(), target.String())
+		if err := conn.write(arpReply(conn.iface.HardwareAddr, senderMAC, target, sender)); err != nil {
+			errorf("ARP reply for %s: %s", target.String(), err)
+		}
+	}
+}
+
+// arpReply builds an ethernet frame holding an ARP reply telling dst that ip is at srcMAC
+func arpReply(srcMAC, dstMAC net.HardwareAddr, ip, dst net.IP) []byte {
+	frame := make([]byte, arpLen)
+	copy(frame[0:6], dstMAC)
+	copy(frame[6:12], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], syscall.ETH_P_ARP)
+
+	arp := frame[ethHeaderLen:]
+	binary.BigEndian.PutUint16(arp[0:2], 1)
+	binary.BigEndian.PutUint16(arp[2:4], syscall.ETH_P_IP)
+	arp[4] = 6
+	arp[5] = 4
+	binary.BigEndian.PutUint16(arp[6:8], 2) // reply
+	copy(arp[8:14], srcMAC)
+	copy(arp[14:18], ip.To4())
+	copy(arp[18:24], dstMAC)
+	copy(arp[24:28], dst.To4())
+	return frame
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// runARPProxy is not supported on this platform
+func runARPProxy(iface string, cidr *net.IPNet) error {
+	return errors.New("-arp-proxy is only supported on linux")
+}
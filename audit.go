@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/haxii/socks5"
+)
+
+// requestKey is the context key the rule set stores the socks5.Request under for the audit log
+type requestKey struct{}
+
+// auditRecord is a line of the -audit-log
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Dest      string    `json:"dest"`
+	DestIP    string    `json:"dest_ip,omitempty"`
+	Egress    string    `json:"egress,omitempty"`
+	BytesUp   uint64    `json:"bytes_up"`
+	BytesDown uint64    `json:"bytes_down"`
+	Duration  float64   `json:"duration"` // seconds
+	Result    string    `json:"result"`
+}
+
+// auditLog writes audit records to a file, rotating it by size
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+}
+
+// audit is the -audit-log, nil when disabled
+var audit *auditLog
+
+// initAudit opens -audit-log and reopens it on SIGHUP for external rotation
+func initAudit() error {
+	if *auditPath == "" {
+		return nil
+	}
+	audit = &auditLog{path: *auditPath}
+	if err := audit.open(); err != nil {
+		return err
+	}
+	onExit(func() {
+		audit.mu.Lock()
+		defer audit.mu.Unlock()
+		audit.f.Close()
+	})
+
+	onReload("audit log", func() error {
+		audit.mu.Lock()
+		defer audit.mu.Unlock()
+		old := audit.f
+		if err := audit.open(); err != nil {
+			return err
+		}
+		old.Close()
+		return nil
+	})
+	return nil
+}
+
+// open opens the log file for appending
+// a.mu must be held once the log is in use
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// rotate renames the log to path.1, shifting older logs up to -audit-log-keep, and starts a new one
+// a.mu must be held
+func (a *auditLog) rotate() error {
+	a.f.Close()
+	for i := *auditKeep - 1; i >= 1; i-- {
+		os.Rename(a.path+"."+strconv.Itoa(i), a.path+"."+strconv.Itoa(i+1))
+	}
+	if *auditKeep > 0 {
+		os.Rename(a.path, a.path+".1")
+	} else {
+		os.Remove(a.path)
+	}
+	return a.open()
+}
+
+// write appends rec to the log
+func (a *auditLog) write(rec *auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		errorf("audit log: %s", err)
+		return
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if *auditMaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > *auditMaxSize<<20 {
+		if err := a.rotate(); err != nil {
+			errorf("audit log rotation failed: %s", err)
+			return
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		errorf("audit log: %s", err)
+	}
+}
+
+// newAuditRecord returns a record describing req, or addr if the request is unknown
+func newAuditRecord(req *socks5.Request, addr string) *auditRecord {
+	rec := &auditRecord{Time: time.Now(), Dest: addr}
+	if req == nil {
+		return rec
+	}
+	if req.RemoteAddr != nil {
+		rec.Client = net.JoinHostPort(req.RemoteAddr.IP.String(), strconv.Itoa(req.RemoteAddr.Port))
+	}
+	if req.AuthContext != nil {
+		rec.User = req.AuthContext.Payload["Username"]
+	}
+	if req.DestAddr != nil {
+		rec.Dest = net.JoinHostPort(destName(req.DestAddr), strconv.Itoa(req.DestAddr.Port))
+		if req.DestAddr.IP != nil {
+			rec.DestIP = req.DestAddr.IP.String()
+		}
+	}
+	return rec
+}
+
+// auditDenied logs a request refused by the rule set
+func auditDenied(req *socks5.Request, reason string) {
+	if audit == nil {
+		return
+	}
+	rec := newAuditRecord(req, "")
+	rec.Result = "denied: " + reason
+	audit.write(rec)
+}
+
+// auditStart returns the record of a connection to addr egressing on egress, completed and written by proxyConn
+// when it closes, nil if the audit log is disabled or dialing failed, which is logged right away
+func auditStart(ctx context.Context, egress, addr string, err error) *auditRecord {
+	if audit == nil {
+		return nil
+	}
+	req, _ := ctx.Value(requestKey{}).(*socks5.Request)
+	rec := newAuditRecord(req, addr)
+	rec.Egress = egress
+	if err != nil {
+		rec.Result = "dial failed: " + err.Error()
+		audit.write(rec)
+		return nil
+	}
+	return rec
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	cleanupMu sync.Mutex
+	cleanups  []func()
+	reloaders []reloader
+)
+
+// reloader is a function run on SIGHUP, named for its log messages
+type reloader struct {
+	name string
+	fn   func() error
+}
+
+// onExit registers fn to be run before stargate exits on a signal or fatal error
+func onExit(fn func()) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	cleanups = append(cleanups, fn)
+}
+
+// runCleanup runs the registered functions in reverse order, each at most once
+func runCleanup() {
+	cleanupMu.Lock()
+	fns := cleanups
+	cleanups = nil
+	cleanupMu.Unlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		fns[i]()
+	}
+}
+
+// onReload registers fn to be run when SIGHUP is received
+// fn should keep its previous state if it returns an error
+// SIGHUP is only caught once something is registered, otherwise it still terminates stargate
+func onReload(name string, fn func() error) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	if len(reloaders) == 0 {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				runReload()
+			}
+		}()
+	}
+	reloaders = append(reloaders, reloader{name: name, fn: fn})
+}
+
+// runReload runs the registered reload functions in order
+func runReload() {
+	cleanupMu.Lock()
+	rs := reloaders
+	cleanupMu.Unlock()
+	for _, r := range rs {
+		if err := r.fn(); err != nil {
+			errorf("%s reload failed, keeping the previous state: %s", r.name, err)
+		}
+	}
+}
+
+// handleSignals cleans up and exits when an interrupt or terminate signal is received
+func handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		l.Printf("received %s, shutting down", s)
+		runCleanup()
+		os.Exit(0)
+	}()
+}
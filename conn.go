@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyConn is an outbound connection with the bandwidth limits, timeouts, statistics and audit record
+// requested by flags
+// closing the upstream connection on a timeout makes the SOCKS relay tear down the client side as well
+type proxyConn struct {
+	lastActive int64 // unix nanoseconds, the counters are first for 64-bit atomic alignment
+	bytesUp    uint64
+	bytesDown  uint64
+	net.Conn
+	up    []*tokenBucket // client to destination, applied to writes
+	down  []*tokenBucket // destination to client, applied to reads
+	stats *egressStats   // nil unless statistics are enabled
+	rec   *auditRecord   // nil unless the audit log is enabled
+
+	mu        sync.Mutex
+	idle      *time.Timer
+	lifetime  *time.Timer
+	reason    string // why the connection was closed by a timer
+	err       error  // first error other than the connection ending normally
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// wrapConn counts the result of dialing addr from egress, and wraps conn if it succeeded
+// conn is returned unchanged if no flag needs a wrapper, so relayed reads and writes are not accounted for
+func wrapConn(ctx context.Context, egress, addr string, conn net.Conn, err error) (net.Conn, error) {
+	stats := egressCounters(egress)
+	rec := auditStart(ctx, egress, addr, err)
+	if err != nil {
+		if stats != nil {
+			atomic.AddUint64(&stats.Failures, 1)
+		}
+		return nil, err
+	}
+	if stats != nil {
+		atomic.AddUint64(&stats.Connections, 1)
+		atomic.AddInt64(&stats.Active, 1)
+	}
+	up, down := rateLimits()
+	if stats == nil && rec == nil && len(up) == 0 && len(down) == 0 && *idleTimeout <= 0 && *maxLifetime <= 0 {
+		return conn, nil
+	}
+	c := &proxyConn{
+		Conn:       conn,
+		lastActive: time.Now().UnixNano(),
+		up:         up,
+		down:       down,
+		stats:      stats,
+		rec:        rec,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *idleTimeout > 0 {
+		c.idle = time.AfterFunc(*idleTimeout, c.checkIdle)
+	}
+	if *maxLifetime > 0 {
+		c.lifetime = time.AfterFunc(*maxLifetime, func() {
+			v("closing connection to %s: lifetime %s exceeded", c.RemoteAddr(), *maxLifetime)
+			c.expire("max lifetime")
+		})
+	}
+	return c, nil
+}
+
+// checkIdle closes the connection if it has been idle for the timeout, otherwise re-arms the timer
+func (c *proxyConn) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+	if idle >= *idleTimeout {
+		v("closing connection to %s: idle for %s", c.RemoteAddr(), *idleTimeout)
+		c.expire("idle timeout")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle != nil {
+		c.idle.Reset(*idleTimeout - idle)
+	}
+}
+
+// expire closes the connection, recording reason for the audit log
+func (c *proxyConn) expire(reason string) {
+	c.mu.Lock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+	c.mu.Unlock()
+	c.Close()
+}
+
+// transferred records n bytes moved in either direction and the first unexpected error
+func (c *proxyConn) transferred(n int, counter *uint64, err error) {
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+		atomic.AddUint64(counter, uint64(n))
+	}
+	if err == nil || err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
+		return
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+// Read reads from upstream, then waits for the bytes read to be allowed
+func (c *proxyConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for _, b := range c.down {
+		b.wait(n)
+	}
+	c.transferred(n, &c.bytesDown, err)
+	if c.stats != nil {
+		atomic.AddUint64(&c.stats.BytesDown, uint64(n))
+	}
+	return n, err
+}
+
+// Write waits for len(p) bytes to be allowed, then writes them upstream
+func (c *proxyConn) Write(p []byte) (int, error) {
+	for _, b := range c.up {
+		b.wait(len(p))
+	}
+	n, err := c.Conn.Write(p)
+	c.transferred(n, &c.bytesUp, err)
+	if c.stats != nil {
+		atomic.AddUint64(&c.stats.BytesUp, uint64(n))
+	}
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the connection if supported, the relay uses it to half-close tunnels
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close stops the timers, closes the connection and writes its audit record
+func (c *proxyConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		if c.idle != nil {
+			c.idle.Stop()
+			c.idle = nil
+		}
+		if c.lifetime != nil {
+			c.lifetime.Stop()
+			c.lifetime = nil
+		}
+		result := "closed"
+		if c.reason != "" {
+			result = c.reason
+		} else if c.err != nil {
+			result = fmt.Sprintf("error: %s", c.err)
+		}
+		c.mu.Unlock()
+		c.closeErr = c.Conn.Close()
+		if c.stats != nil {
+			atomic.AddInt64(&c.stats.Active, -1)
+		}
+		if c.rec != nil {
+			c.rec.BytesUp = atomic.LoadUint64(&c.bytesUp)
+			c.rec.BytesDown = atomic.LoadUint64(&c.bytesDown)
+			c.rec.Duration = time.Since(c.rec.Time).Seconds()
+			c.rec.Result = result
+			audit.write(c.rec)
+		}
+	})
+	return c.closeErr
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+)
+
+// dashboardRefresh is how often the dashboard reloads, in seconds
+const dashboardRefresh = 5
+
+// dashboardCell is a prefix in the usage heatmap
+type dashboardCell struct {
+	egressStats
+	Heat      int // 0-9, relative to the busiest prefix
+	ErrorRate float64
+}
+
+// dashboardData is rendered by dashboardTemplate
+type dashboardData struct {
+	Refresh     int
+	Active      int64
+	Connections uint64
+	Failures    uint64
+	ErrorRate   float64
+	BytesUp     uint64
+	BytesDown   uint64
+	DNSFailures map[string]int64
+	Prefixes    []dashboardCell
+	Ready       bool
+	Listening   int
+	Listeners   int
+}
+
+// handleDashboard renders an overview of the proxy for quick triage without a metrics stack
+// the heatmap sums egress addresses per prefix4 and prefix6, /24 and /64 by default
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	bits4, err := queryInt(query.Get("prefix4"), 0, 32, 24)
+	if err != nil {
+		http.Error(w, "invalid prefix4: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bits6, err := queryInt(query.Get("prefix6"), 0, 128, 64)
+	if err != nil {
+		http.Error(w, "invalid prefix6: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := dashboardData{Refresh: dashboardRefresh}
+	var busiest uint64
+	for _, s := range groupEgressStats(snapshotEgressStats(), bits4, bits6) {
+		data.Active += s.Active
+		data.Connections += s.Connections
+		data.Failures += s.Failures
+		data.BytesUp += s.BytesUp
+		data.BytesDown += s.BytesDown
+		if s.BytesUp+s.BytesDown > busiest {
+			busiest = s.BytesUp + s.BytesDown
+		}
+		data.Prefixes = append(data.Prefixes, dashboardCell{egressStats: s, ErrorRate: errorRate(s.Failures, s.Connections)})
+	}
+	for i := range data.Prefixes {
+		if busiest > 0 {
+			cell := &data.Prefixes[i]
+			cell.Heat = int(9 * (cell.BytesUp + cell.BytesDown) / busiest)
+		}
+	}
+	sort.Slice(data.Prefixes, func(i, j int) bool {
+		return data.Prefixes[i].Egress < data.Prefixes[j].Egress
+	})
+	data.ErrorRate = errorRate(data.Failures, data.Connections)
+
+	// the expvar map renders as JSON
+	json.Unmarshal([]byte(dnsFailureKinds.String()), &data.DNSFailures)
+
+	listenersMu.Lock()
+	data.Listeners = len(listeners)
+	for _, s := range listeners {
+		if s.Ready {
+			data.Listening++
+		}
+	}
+	listenersMu.Unlock()
+	data.Ready = data.Listening == data.Listeners
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		v("dashboard: %s", err)
+	}
+}
+
+// errorRate returns the percentage of attempts that failed
+func errorRate(failures, connections uint64) float64 {
+	if failures+connections == 0 {
+		return 0
+	}
+	return 100 * float64(failures) / float64(failures+connections)
+}
+
+// dashboardTemplate is the dashboard page, kept inline as the module predates go:embed
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>stargate</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.3em 0.8em; text-align: right; }
+th { text-align: left; }
+.grid { display: flex; flex-wrap: wrap; gap: 4px; }
+.cell { width: 13em; padding: 0.4em; font-size: 0.8em; color: #000; }
+.heat0 { background: #f0f4f8; } .heat1 { background: #d9e6f2; } .heat2 { background: #c2d8ec; }
+.heat3 { background: #a9c9e5; } .heat4 { background: #8fb9de; } .heat5 { background: #74a8d6; color: #fff; }
+.heat6 { background: #5896cd; color: #fff; } .heat7 { background: #3c83c2; color: #fff; }
+.heat8 { background: #2a6ca6; color: #fff; } .heat9 { background: #1b5386; color: #fff; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>stargate</h1>
+<p>Listeners: {{.Listening}}/{{.Listeners}} {{if .Ready}}ready{{else}}<span class="bad">not ready</span>, see <a href="/readyz">/readyz</a>{{end}}</p>
+<table>
+<tr><th>Live connections</th><td>{{.Active}}</td></tr>
+<tr><th>Connections</th><td>{{.Connections}}</td></tr>
+<tr><th>Failed dials</th><td>{{.Failures}} ({{printf "%.1f" .ErrorRate}}%)</td></tr>
+<tr><th>Bytes up</th><td>{{.BytesUp}}</td></tr>
+<tr><th>Bytes down</th><td>{{.BytesDown}}</td></tr>
+{{range $kind, $n := .DNSFailures}}<tr><th>DNS failures ({{$kind}})</th><td>{{$n}}</td></tr>
+{{end}}</table>
+<h2>Usage by prefix</h2>
+{{if .Prefixes}}<div class="grid">
+{{range .Prefixes}}<div class="cell heat{{.Heat}}" title="last used {{.LastUsed.Format "2006-01-02 15:04:05"}}">
+<b>{{.Egress}}</b><br>
+{{.Active}} live, {{.Connections}} total<br>
+{{.BytesUp}} up, {{.BytesDown}} down<br>
+{{if .Failures}}<span class="bad">{{.Failures}} failed ({{printf "%.1f" .ErrorRate}}%)</span>{{else}}no failures{{end}}
+</div>
+{{end}}</div>
+{{else}}<p>No connections yet.</p>{{end}}
+<p>Raw counters: <a href="/stats">/stats</a></p>
+</body>
+</html>
+`))
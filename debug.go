@@ -0,0 +1,13 @@
+package main
+
+import (
+	_ "expvar" // serves /debug/vars
+	"net/http"
+	_ "net/http/pprof" // serves /debug/pprof/
+)
+
+// runDebug serves the pprof profiles and expvar variables registered on the default mux on listenAddr
+func runDebug(listenAddr string) error {
+	l.Printf("Starting debug server %s\n", listenAddr)
+	return http.ListenAndServe(listenAddr, nil)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsCache caches lookups for the TTL of their records if -dns-cache is set, and failures for -dns-negative-ttl
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+	ttls    map[string]time.Duration // lowest answer TTLs seen on the wire, keyed by question name
+	max     int
+}
+
+// dnsCacheEntry is a cached lookup result
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// cache is the lookup cache shared by every resolver, nil when disabled
+var cache *dnsCache
+
+// negativeCacheSize bounds the cache when only failures are cached
+const negativeCacheSize = 1000
+
+// initDNSCache enables the cache if -dns-cache or -dns-negative-ttl is set, both are off by default
+func initDNSCache() {
+	size := *dnsCacheSize
+	if size <= 0 {
+		if *dnsNegativeTTL <= 0 {
+			return
+		}
+		size = negativeCacheSize
+	}
+	cache = &dnsCache{
+		entries: make(map[string]*dnsCacheEntry),
+		ttls:    make(map[string]time.Duration),
+		max:     size,
+	}
+}
+
+// lookup returns the cached result for name, performing the lookup with r if there is none
+func (c *dnsCache) lookup(ctx context.Context, r *net.Resolver, name string) ([]net.IPAddr, error) {
+	key := dnsKey(name)
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		v("cached %q", name)
+		return e.addrs, e.err
+	}
+	c.mu.Unlock()
+
+	addrs, err := lookupIPAddr(ctx, r, name)
+	if err != nil && !negativeCacheable(ctx, err) {
+		// timeouts, cancelled lookups and failures to reach the server say nothing about the name
+		return addrs, err
+	}
+	ttl := *dnsNegativeTTL
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		if *dnsCacheSize <= 0 {
+			return addrs, err
+		}
+		ttl = *dnsCacheMaxTTL
+		if wire, ok := c.ttls[key]; ok && wire < ttl {
+			ttl = wire
+		}
+	}
+	delete(c.ttls, key)
+	if ttl > 0 {
+		c.evict(now)
+		c.entries[key] = &dnsCacheEntry{addrs: addrs, err: err, expires: now.Add(ttl)}
+	}
+	return addrs, err
+}
+
+// error texts the Go resolver reports DNS server answers with, other failures carry the network error instead
+const (
+	dnsErrNoSuchHost = "no such host"       // NXDOMAIN, or no records
+	dnsErrServFail   = "server misbehaving" // SERVFAIL, also reported as temporary
+)
+
+// negativeCacheable returns true for failures the DNS server answered with, NXDOMAIN and SERVFAIL
+func negativeCacheable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsTimeout {
+		return false
+	}
+	return (dnsErr.IsNotFound && dnsErr.Err == dnsErrNoSuchHost) ||
+		(dnsErr.IsTemporary && dnsErr.Err == dnsErrServFail)
+}
+
+// evict makes room for a new entry by removing expired entries, or an arbitrary one if none have expired
+// c.mu must be held
+func (c *dnsCache) evict(now time.Time) {
+	if len(c.entries) < c.max {
+		return
+	}
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.max {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// recordTTL notes the TTL of a reply seen on the wire so the lookup it belongs to can be cached for it
+func (c *dnsCache) recordTTL(msg []byte) {
+	name, ttl, ok := dnsAnswerTTL(msg)
+	if !ok {
+		return
+	}
+	d := time.Duration(ttl) * time.Second
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.ttls) >= c.max {
+		// lookups that never finished, only the most recent matter
+		c.ttls = make(map[string]time.Duration)
+	}
+	// A and AAAA replies for the same name are combined
+	if prev, ok := c.ttls[name]; !ok || d < prev {
+		c.ttls[name] = d
+	}
+}
+
+// dnsKey normalizes a name for use as a cache key
+func dnsKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNegativeCacheable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"nxdomain", context.Background(), &net.DNSError{Err: dnsErrNoSuchHost, Name: "example.com", IsNotFound: true}, true},
+		{"servfail", context.Background(), &net.DNSError{Err: dnsErrServFail, Name: "example.com", IsTemporary: true}, true},
+		{"timeout", context.Background(), &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, false},
+		{"cancelled", cancelled, &net.DNSError{Err: dnsErrNoSuchHost, Name: "example.com", IsNotFound: true}, false},
+		{"temporary network error", context.Background(), &net.DNSError{Err: "read udp 192.0.2.1:53: connection refused", Name: "example.com", IsTemporary: true}, false},
+		{"dial error", context.Background(), &net.DNSError{Err: "dial udp 192.0.2.1:53: connect: network is unreachable", Name: "example.com"}, false},
+		{"server name not found", context.Background(), &net.DNSError{Err: "lookup dns.invalid on 192.0.2.1:53: no such host", Name: "example.com", IsNotFound: true}, false},
+		{"no egress address", context.Background(), &net.DNSError{Err: "no egress address can reach DNS server 192.0.2.1:53", Name: "example.com"}, false},
+		{"not a DNS error", context.Background(), errors.New("no such host"), false},
+	}
+	for _, test := range tests {
+		if got := negativeCacheable(test.ctx, test.err); got != test.want {
+			t.Errorf("%s: negativeCacheable(%v) = %t, want %t", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+// rcodeResolver returns a Go resolver whose server answers every query with rcode
+func rcodeResolver(rcode byte) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				for {
+					query, err := readDNSFrame(server)
+					if err != nil || len(query) < dnsHeaderLen {
+						return
+					}
+					// echo the question back with no answers
+					reply := append([]byte(nil), query...)
+					reply[2] = 0x81
+					reply[3] = 0x80 | rcode
+					binary.BigEndian.PutUint16(reply[6:], 0)
+					binary.BigEndian.PutUint16(reply[8:], 0)
+					binary.BigEndian.PutUint16(reply[10:], 0)
+					end, err := dnsSkipName(reply, dnsHeaderLen)
+					if err != nil {
+						return
+					}
+					if err := writeDNSFrame(server, reply[:end+4]); err != nil {
+						return
+					}
+				}
+			}()
+			return client, nil
+		},
+	}
+}
+
+// TestNegativeCacheableResolver checks the error texts against those of the Go resolver
+func TestNegativeCacheableResolver(t *testing.T) {
+	for _, test := range []struct {
+		rcode byte
+		want  bool
+	}{
+		{3, true}, // NXDOMAIN
+		{2, true}, // SERVFAIL
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := rcodeResolver(test.rcode).LookupIPAddr(ctx, "example.com.")
+		cancel()
+		if err == nil {
+			t.Fatalf("rcode %d: lookup succeeded", test.rcode)
+		}
+		if got := negativeCacheable(context.Background(), err); got != test.want {
+			t.Errorf("rcode %d: negativeCacheable(%#v) = %t, want %t", test.rcode, err, got, test.want)
+		}
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	defer func(old time.Duration) { *dnsNegativeTTL = old }(*dnsNegativeTTL)
+	*dnsNegativeTTL = time.Minute
+	c := &dnsCache{entries: make(map[string]*dnsCacheEntry), ttls: make(map[string]time.Duration), max: 10}
+
+	if _, err := c.lookup(context.Background(), rcodeResolver(3), "missing.example."); err == nil {
+		t.Fatal("lookup of NXDOMAIN succeeded")
+	}
+	if _, ok := c.entries["missing.example"]; !ok {
+		t.Error("NXDOMAIN was not cached")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.lookup(cancelled, rcodeResolver(3), "cancelled.example.")
+	if _, ok := c.entries["cancelled.example"]; ok {
+		t.Error("cancelled lookup was cached")
+	}
+
+	unreachable := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, fmt.Errorf("no egress address can reach DNS server %s", address)
+		},
+	}
+	c.lookup(context.Background(), unreachable, "unreachable.example.")
+	if _, ok := c.entries["unreachable.example"]; ok {
+		t.Error("failure to reach the server was cached")
+	}
+}
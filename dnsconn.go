@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// dnsConn inspects the DNS messages on a stream connection to a DNS server
+type dnsConn struct {
+	net.Conn
+	in  []byte // replies read but not yet complete
+	out []byte // inspected replies not yet returned
+}
+
+// dnsPacketConn inspects the DNS messages on a packet connection to a DNS server
+// it stays a net.PacketConn so the resolver keeps using datagram framing
+type dnsPacketConn struct {
+	net.PacketConn
+	net.Conn
+}
+
+// inspectReplies wraps a connection to a DNS server so the cache and -dnssec see the messages
+func inspectReplies(conn net.Conn) net.Conn {
+	if *dnsCacheSize <= 0 && !*dnssec {
+		return conn
+	}
+	if pc, ok := conn.(net.PacketConn); ok {
+		return &dnsPacketConn{PacketConn: pc, Conn: conn}
+	}
+	return &dnsConn{Conn: conn}
+}
+
+// inspectQuery updates a query before it is sent
+func inspectQuery(msg []byte) {
+	if *dnssec && len(msg) >= dnsHeaderLen {
+		// ask for the AD bit in the reply (RFC 6840 section 5.7)
+		msg[3] |= dnsFlagAD
+	}
+}
+
+// inspectReply records the TTLs of a reply for the cache, and turns unauthenticated answers into server
+// failures with -dnssec
+func inspectReply(msg []byte) {
+	if len(msg) < dnsHeaderLen {
+		return
+	}
+	if *dnsCacheSize > 0 {
+		cache.recordTTL(msg)
+	}
+	if *dnssec && msg[3]&dnsRcodeMask == dnsRcodeSuccess &&
+		binary.BigEndian.Uint16(msg[6:]) > 0 && msg[3]&dnsFlagAD == 0 {
+		name, _ := dnsReadName(msg, dnsHeaderLen)
+		v("rejecting unauthenticated DNS answer for %q", name)
+		msg[3] = msg[3]&^dnsRcodeMask | dnsRcodeServFail
+	}
+}
+
+// Write sends a query
+func (c *dnsPacketConn) Write(b []byte) (int, error) {
+	msg := append([]byte(nil), b...)
+	inspectQuery(msg)
+	return c.Conn.Write(msg)
+}
+
+// Read reads and inspects a reply
+func (c *dnsPacketConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		inspectReply(b[:n])
+	}
+	return n, err
+}
+
+// the methods both embedded types provide
+func (c *dnsPacketConn) Close() error                       { return c.Conn.Close() }
+func (c *dnsPacketConn) LocalAddr() net.Addr                { return c.Conn.LocalAddr() }
+func (c *dnsPacketConn) SetDeadline(t time.Time) error      { return c.Conn.SetDeadline(t) }
+func (c *dnsPacketConn) SetReadDeadline(t time.Time) error  { return c.Conn.SetReadDeadline(t) }
+func (c *dnsPacketConn) SetWriteDeadline(t time.Time) error { return c.Conn.SetWriteDeadline(t) }
+
+// Write sends a length prefixed query, which the resolver writes in a single call
+func (c *dnsConn) Write(b []byte) (int, error) {
+	msg := append([]byte(nil), b...)
+	if len(msg) > 2 {
+		inspectQuery(msg[2:])
+	}
+	return c.Conn.Write(msg)
+}
+
+// Read returns length prefixed replies once they are complete and inspected
+func (c *dnsConn) Read(b []byte) (int, error) {
+	for len(c.out) == 0 {
+		if len(c.in) >= 2 {
+			end := 2 + int(binary.BigEndian.Uint16(c.in))
+			if len(c.in) >= end {
+				inspectReply(c.in[2:end])
+				c.out = append(c.out, c.in[:end]...)
+				c.in = c.in[end:]
+				break
+			}
+		}
+		buf := make([]byte, 4096)
+		n, err := c.Conn.Read(buf)
+		c.in = append(c.in, buf[:n]...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// dnsForwardTimeout bounds each forwarded query
+const dnsForwardTimeout = 10 * time.Second
+
+// runDNSForwarder answers DNS queries on listenAddr over UDP and TCP by forwarding them upstream
+// from egress addresses returned by pick, rotating through the servers if there are several
+func runDNSForwarder(listenAddr string, pick func(dest net.IP) net.IP) error {
+	servers, err := dnsUpstreams()
+	if err != nil {
+		setListener(listenAddr, err)
+		return err
+	}
+	f := &dnsForwarder{pick: pick}
+	for _, server := range servers {
+		f.upstreams = append(f.upstreams, dnsUpstream{
+			dial: dnsDialer(server),
+			host: dnsServerHost(server),
+		})
+	}
+
+	pc, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		setListener(listenAddr, err)
+		return err
+	}
+	ln, err := listen("tcp", listenAddr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	l.Printf("Starting DNS forwarder %s to %s\n", listenAddr, strings.Join(servers, ","))
+	var g errgroup.Group
+	g.Go(func() error {
+		return f.serveUDP(pc)
+	})
+	g.Go(func() error {
+		return f.serveTCP(ln)
+	})
+	err = g.Wait()
+	stopped(listenAddr, err)
+	return err
+}
+
+// systemNameservers returns the nameservers in /etc/resolv.conf
+func systemNameservers() ([]string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, withPort(fields[1], "53"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no nameserver in /etc/resolv.conf, pass -dns")
+	}
+	return servers, nil
+}
+
+// dnsForwarder relays DNS messages to the upstream servers
+type dnsForwarder struct {
+	upstreams []dnsUpstream
+	next      uint32
+	pick      func(dest net.IP) net.IP
+}
+
+// dnsUpstream is a server queries are forwarded to
+type dnsUpstream struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+	host string // address or name of the server
+}
+
+// serveUDP answers queries received on pc
+func (f *dnsForwarder) serveUDP(pc net.PacketConn) error {
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			reply, err := f.forward("udp", query)
+			if err != nil {
+				v("DNS forward for %s failed: %s", addr.String(), err)
+				return
+			}
+			pc.WriteTo(reply, addr)
+		}()
+	}
+}
+
+// serveTCP answers length prefixed queries on connections accepted from ln
+func (f *dnsForwarder) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+				query, err := readDNSFrame(conn)
+				if err != nil {
+					return
+				}
+				reply, err := f.forward("tcp", query)
+				if err != nil {
+					v("DNS forward for %s failed: %s", conn.RemoteAddr().String(), err)
+					return
+				}
+				if err := writeDNSFrame(conn, reply); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// forward sends query upstream from a random egress address and returns the reply
+func (f *dnsForwarder) forward(network string, query []byte) ([]byte, error) {
+	upstream := f.upstreams[atomic.AddUint32(&f.next, 1)%uint32(len(f.upstreams))]
+	ctx, cancel := context.WithTimeout(context.Background(), dnsForwardTimeout)
+	defer cancel()
+	src, err := f.source(ctx, upstream.host)
+	if err != nil {
+		return nil, err
+	}
+	switch *dnsECS {
+	case "strip":
+		var err error
+		if query, err = dnsSetECS(query, nil); err != nil {
+			return nil, err
+		}
+	case "egress":
+		var err error
+		if query, err = dnsSetECS(query, ecsOption(src)); err != nil {
+			return nil, err
+		}
+	}
+
+	// dialDNS picks the server address in the family of src
+	ctx = context.WithValue(ctx, dnsSourceKey{}, func(net.IP) net.IP {
+		return src
+	})
+	conn, err := upstream.dial(ctx, network, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 0xffff)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	// DNS over TLS and HTTPS connections use TCP framing
+	if err := writeDNSFrame(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSFrame(conn)
+}
+
+// source returns the egress address to send a query to the server at host from
+func (f *dnsForwarder) source(ctx context.Context, host string) (net.IP, error) {
+	dests, err := dnsServerIPs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, dest := range dests {
+		src := f.pick(dest)
+		// local servers are dialed from the loopback address, src is only used for ECS
+		if dest.IsLoopback() || getIPNetwork(&src) == getIPNetwork(&dest) {
+			return src, nil
+		}
+	}
+	return nil, fmt.Errorf("no egress address can reach DNS server %s", host)
+}
+
+// readDNSFrame reads a length prefixed DNS message
+func readDNSFrame(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// writeDNSFrame writes msg with a length prefix
+func writeDNSFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// minimal DNS message parsing, enough to inspect replies passing through the resolver
+
+// dnsHeaderLen is the length of the fixed DNS message header
+const dnsHeaderLen = 12
+
+// header flags in the fourth byte of a message
+const (
+	dnsFlagAD        = 0x20
+	dnsRcodeMask     = 0x0f
+	dnsRcodeSuccess  = 0
+	dnsRcodeServFail = 2
+)
+
+var errDNSMsg = errors.New("malformed DNS message")
+
+// dnsSkipName returns the offset just past the name starting at off
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSMsg
+		}
+		c := int(msg[off])
+		switch {
+		case c == 0:
+			return off + 1, nil
+		case c&0xc0 == 0xc0:
+			// compression pointer ends the name
+			return off + 2, nil
+		default:
+			off += c + 1
+		}
+	}
+}
+
+// dnsReadName returns the name starting at off in lowercase without the trailing dot
+func dnsReadName(msg []byte, off int) (string, error) {
+	var labels []string
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", errDNSMsg
+		}
+		c := int(msg[off])
+		switch {
+		case c == 0:
+			return strings.ToLower(strings.Join(labels, ".")), nil
+		case c&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", errDNSMsg
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+c > len(msg) {
+				return "", errDNSMsg
+			}
+			labels = append(labels, string(msg[off+1:off+1+c]))
+			off += c + 1
+		}
+	}
+	return "", errDNSMsg
+}
+
+// dnsAnswerTTL returns the question name of a reply and the lowest TTL of its answers
+// ok is false if the message is not a reply with at least one answer
+func dnsAnswerTTL(msg []byte) (name string, ttl uint32, ok bool) {
+	if len(msg) < dnsHeaderLen || msg[2]&0x80 == 0 {
+		return "", 0, false
+	}
+	qdCount := binary.BigEndian.Uint16(msg[4:])
+	anCount := binary.BigEndian.Uint16(msg[6:])
+	if qdCount != 1 || anCount == 0 {
+		return "", 0, false
+	}
+	name, err := dnsReadName(msg, dnsHeaderLen)
+	if err != nil {
+		return "", 0, false
+	}
+	off, err := dnsSkipName(msg, dnsHeaderLen)
+	if err != nil {
+		return "", 0, false
+	}
+	off += 4 // type and class
+	for i := 0; i < int(anCount); i++ {
+		if off, err = dnsSkipName(msg, off); err != nil || off+10 > len(msg) {
+			return "", 0, false
+		}
+		rrTTL := binary.BigEndian.Uint32(msg[off+4:])
+		if i == 0 || rrTTL < ttl {
+			ttl = rrTTL
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	return name, ttl, true
+}
+
+const (
+	dnsTypeOPT   = 41
+	ednsECS      = 8    // EDNS Client Subnet option code (RFC 7871)
+	ednsUDPSize  = 1232 // UDP payload size advertised in added OPT records
+	ecsBits4     = 24   // source prefix length of added IPv4 client subnets
+	ecsBits6     = 56   // source prefix length of added IPv6 client subnets
+	dnsRRHeadLen = 10   // type, class, TTL and rdata length following a record name
+)
+
+// ecsOption returns an EDNS Client Subnet option for the network ip is in
+func ecsOption(ip net.IP) []byte {
+	family, bits, addr := uint16(2), ecsBits6, ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		family, bits, addr = 1, ecsBits4, ip4
+	}
+	addr = addr.Mask(net.CIDRMask(bits, len(addr)*8))[:(bits+7)/8]
+	opt := make([]byte, 8+len(addr))
+	binary.BigEndian.PutUint16(opt, ednsECS)
+	binary.BigEndian.PutUint16(opt[2:], uint16(4+len(addr)))
+	binary.BigEndian.PutUint16(opt[4:], family)
+	opt[6] = byte(bits)
+	copy(opt[8:], addr)
+	return opt
+}
+
+// dnsSetECS returns query with any EDNS Client Subnet option removed, and ecs added if not nil
+// an OPT record is added to queries without one only when there is an option to add
+func dnsSetECS(query []byte, ecs []byte) ([]byte, error) {
+	if len(query) < dnsHeaderLen {
+		return nil, errDNSMsg
+	}
+	var counts [4]int
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(query[4+2*i:]))
+	}
+	off := dnsHeaderLen
+	var err error
+	for i := 0; i < counts[0]; i++ {
+		if off, err = dnsSkipName(query, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	for i := 0; i < counts[1]+counts[2]+counts[3]; i++ {
+		if off, err = dnsSkipName(query, off); err != nil || off+dnsRRHeadLen > len(query) {
+			return nil, errDNSMsg
+		}
+		rdStart := off + dnsRRHeadLen
+		rdEnd := rdStart + int(binary.BigEndian.Uint16(query[off+8:]))
+		if rdEnd > len(query) {
+			return nil, errDNSMsg
+		}
+		if i < counts[1]+counts[2] || binary.BigEndian.Uint16(query[off:]) != dnsTypeOPT {
+			off = rdEnd
+			continue
+		}
+		// rebuild the OPT record's options without ECS
+		var rdata []byte
+		for opt := rdStart; opt+4 <= rdEnd; {
+			optEnd := opt + 4 + int(binary.BigEndian.Uint16(query[opt+2:]))
+			if optEnd > rdEnd {
+				return nil, errDNSMsg
+			}
+			if binary.BigEndian.Uint16(query[opt:]) != ednsECS {
+				rdata = append(rdata, query[opt:optEnd]...)
+			}
+			opt = optEnd
+		}
+		rdata = append(rdata, ecs...)
+		out := append([]byte(nil), query[:off+8]...)
+		out = append(out, byte(len(rdata)>>8), byte(len(rdata)))
+		out = append(out, rdata...)
+		return append(out, query[rdEnd:]...), nil
+	}
+	if ecs == nil {
+		return query, nil
+	}
+	out := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(out[10:], uint16(counts[3]+1))
+	opt := make([]byte, 1+dnsRRHeadLen)
+	binary.BigEndian.PutUint16(opt[1:], dnsTypeOPT)
+	binary.BigEndian.PutUint16(opt[3:], ednsUDPSize)
+	binary.BigEndian.PutUint16(opt[9:], uint16(len(ecs)))
+	out = append(out, opt...)
+	return append(out, ecs...), nil
+}
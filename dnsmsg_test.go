@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// msg concatenates the parts of a DNS message
+func msg(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// header returns a DNS header with the given flags and section counts
+func header(flags uint16, qd, an, ns, ar uint16) []byte {
+	h := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(h, 0x1234)
+	binary.BigEndian.PutUint16(h[2:], flags)
+	binary.BigEndian.PutUint16(h[4:], qd)
+	binary.BigEndian.PutUint16(h[6:], an)
+	binary.BigEndian.PutUint16(h[8:], ns)
+	binary.BigEndian.PutUint16(h[10:], ar)
+	return h
+}
+
+// optRR returns an OPT record with rdata
+func optRR(rdata ...[]byte) []byte {
+	rd := msg(rdata...)
+	rr := []byte{0, 0, dnsTypeOPT, 0x04, 0xd0, 0, 0, 0, 0, byte(len(rd) >> 8), byte(len(rd))}
+	return append(rr, rd...)
+}
+
+// aRR returns an A record for name with ttl
+func aRR(name []byte, ttl uint32, ip byte) []byte {
+	rr := msg(name, []byte{0, 1, 0, 1}, make([]byte, 4), []byte{0, 4, 192, 0, 2, ip})
+	binary.BigEndian.PutUint32(rr[len(name)+4:], ttl)
+	return rr
+}
+
+var (
+	question  = []byte("\x07example\x03com\x00\x00\x01\x00\x01")
+	cookieOpt = []byte{0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	oldECS    = []byte{0, 8, 0, 7, 0, 1, 24, 0, 10, 0, 0}
+	newECS    = []byte{0, 8, 0, 7, 0, 1, 24, 0, 192, 0, 2}
+)
+
+func TestECSOption(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want []byte
+	}{
+		{"192.0.2.77", newECS},
+		{"2001:db8:1:2ff::1", []byte{0, 8, 0, 11, 0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 1, 2}},
+	}
+	for _, test := range tests {
+		if got := ecsOption(net.ParseIP(test.ip)); !bytes.Equal(got, test.want) {
+			t.Errorf("ecsOption(%s) = %x, want %x", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestDNSSetECS(t *testing.T) {
+	tests := []struct {
+		name  string
+		query []byte
+		ecs   []byte
+		want  []byte
+	}{
+		{
+			name:  "strip without OPT",
+			query: msg(header(0x0100, 1, 0, 0, 0), question),
+			want:  msg(header(0x0100, 1, 0, 0, 0), question),
+		},
+		{
+			name:  "insert without OPT",
+			query: msg(header(0x0100, 1, 0, 0, 0), question),
+			ecs:   newECS,
+			want:  msg(header(0x0100, 1, 0, 0, 1), question, optRR(newECS)),
+		},
+		{
+			name:  "strip from OPT",
+			query: msg(header(0x0100, 1, 0, 0, 1), question, optRR(oldECS, cookieOpt)),
+			want:  msg(header(0x0100, 1, 0, 0, 1), question, optRR(cookieOpt)),
+		},
+		{
+			name:  "replace in OPT",
+			query: msg(header(0x0100, 1, 0, 0, 1), question, optRR(oldECS, cookieOpt)),
+			ecs:   newECS,
+			want:  msg(header(0x0100, 1, 0, 0, 1), question, optRR(cookieOpt, newECS)),
+		},
+		{
+			name:  "insert into OPT",
+			query: msg(header(0x0100, 1, 0, 0, 1), question, optRR(cookieOpt)),
+			ecs:   newECS,
+			want:  msg(header(0x0100, 1, 0, 0, 1), question, optRR(cookieOpt, newECS)),
+		},
+		{
+			name:  "OPT after other additional records",
+			query: msg(header(0x0100, 1, 0, 0, 2), question, aRR([]byte{0xc0, 12}, 60, 1), optRR(oldECS)),
+			ecs:   newECS,
+			want:  msg(header(0x0100, 1, 0, 0, 2), question, aRR([]byte{0xc0, 12}, 60, 1), optRR(newECS)),
+		},
+		{
+			name:  "truncated header",
+			query: header(0x0100, 1, 0, 0, 0)[:5],
+		},
+		{
+			name:  "truncated question",
+			query: msg(header(0x0100, 1, 0, 0, 0), question[:4]),
+		},
+		{
+			name:  "OPT rdata past the end",
+			query: msg(header(0x0100, 1, 0, 0, 1), question, optRR(cookieOpt)[:15]),
+		},
+		{
+			name:  "option past the end of the rdata",
+			query: msg(header(0x0100, 1, 0, 0, 1), question, optRR([]byte{0, 10, 0, 9, 1, 2, 3, 4, 5, 6, 7, 8})),
+		},
+	}
+	for _, test := range tests {
+		got, err := dnsSetECS(test.query, test.ecs)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %x, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !bytes.Equal(got, test.want) {
+			t.Errorf("%s:\ngot  %x\nwant %x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDNSAnswerTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    []byte
+		wantName string
+		wantTTL  uint32
+		wantOK   bool
+	}{
+		{
+			name:     "compressed answers",
+			reply:    msg(header(0x8180, 1, 2, 0, 0), question, aRR([]byte{0xc0, 12}, 300, 1), aRR([]byte{0xc0, 12}, 60, 2)),
+			wantName: "example.com",
+			wantTTL:  60,
+			wantOK:   true,
+		},
+		{
+			name: "label followed by a pointer",
+			reply: msg(header(0x8180, 1, 2, 0, 0), []byte("\x03WWW\x07Example\x03COM\x00\x00\x05\x00\x01"),
+				[]byte{0xc0, 12, 0, 5, 0, 1, 0, 0, 0x0e, 0x10, 0, 2, 0xc0, 16}, aRR([]byte{3, 'w', 'w', 'w', 0xc0, 16}, 120, 1)),
+			wantName: "www.example.com",
+			wantTTL:  120,
+			wantOK:   true,
+		},
+		{
+			name:  "query",
+			reply: msg(header(0x0100, 1, 1, 0, 0), question, aRR([]byte{0xc0, 12}, 60, 1)),
+		},
+		{
+			name:  "no answers",
+			reply: msg(header(0x8183, 1, 0, 0, 0), question),
+		},
+		{
+			name:  "truncated answer",
+			reply: msg(header(0x8180, 1, 1, 0, 0), question, aRR([]byte{0xc0, 12}, 60, 1)[:8]),
+		},
+		{
+			name:  "pointer loop",
+			reply: msg(header(0x8180, 1, 1, 0, 0), []byte{0xc0, 12, 0, 1, 0, 1}, aRR([]byte{0xc0, 12}, 60, 1)),
+		},
+		{
+			name:  "truncated header",
+			reply: header(0x8180, 1, 1, 0, 0)[:7],
+		},
+	}
+	for _, test := range tests {
+		name, ttl, ok := dnsAnswerTTL(test.reply)
+		if name != test.wantName || ttl != test.wantTTL || ok != test.wantOK {
+			t.Errorf("%s: got (%q, %d, %t), want (%q, %d, %t)", test.name, name, ttl, ok, test.wantName, test.wantTTL, test.wantOK)
+		}
+	}
+}
+
+func TestInspectReplyDNSSEC(t *testing.T) {
+	defer func(old bool) { *dnssec = old }(*dnssec)
+	*dnssec = true
+	tests := []struct {
+		name      string
+		reply     []byte
+		wantFlags uint16
+	}{
+		{"authenticated", msg(header(0x81a0, 1, 1, 0, 0), question, aRR([]byte{0xc0, 12}, 60, 1)), 0x81a0},
+		{"unauthenticated", msg(header(0x8180, 1, 1, 0, 0), question, aRR([]byte{0xc0, 12}, 60, 1)), 0x8182},
+		{"no answers", msg(header(0x8180, 1, 0, 0, 0), question), 0x8180},
+		{"nxdomain", msg(header(0x8183, 1, 0, 0, 0), question), 0x8183},
+		{"truncated", header(0x8180, 1, 1, 0, 0)[:6], 0x8180},
+	}
+	for _, test := range tests {
+		inspectReply(test.reply)
+		if got := binary.BigEndian.Uint16(test.reply[2:]); got != test.wantFlags {
+			t.Errorf("%s: flags %#04x, want %#04x", test.name, got, test.wantFlags)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// splitRule sends lookups of names matching pattern to server
+type splitRule struct {
+	pattern string
+	server  string
+}
+
+// splitRules is a flag.Value collecting -dns-rule rules
+type splitRules []splitRule
+
+var (
+	// staticSplitRules holds the -dns-rule rules, checked before -dns-rules
+	staticSplitRules splitRules
+	// currentSplitRules holds the splitRules loaded from -dns-rules, replaced on SIGHUP
+	currentSplitRules atomic.Value
+
+	// splitResolvers holds a resolver for each server so reloads keep their connections
+	splitResolvers   = make(map[string]*net.Resolver)
+	splitResolversMu sync.Mutex
+)
+
+func init() {
+	flag.Var(&staticSplitRules, "dns-rule", "resolve names matching a pattern with another DNS server as `pattern=server`, e.g. \"*.corp=10.0.0.53\", may be repeated")
+}
+
+// String returns the rules in the form accepted by Set
+func (r *splitRules) String() string {
+	rules := make([]string, 0, len(*r))
+	for _, rule := range *r {
+		rules = append(rules, rule.pattern+"="+rule.server)
+	}
+	return strings.Join(rules, ",")
+}
+
+// Set adds a rule of the form "pattern=server"
+func (r *splitRules) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("invalid DNS rule %q, expected pattern=server", s)
+	}
+	*r = append(*r, splitRule{pattern: s[:i], server: s[i+1:]})
+	return nil
+}
+
+// loadSplitRules reads a file of rules, each line a pattern followed by the server for it
+func loadSplitRules(path string) (splitRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules splitRules
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"PATTERN SERVER\", got %q", path, lineNum, line)
+		}
+		rules = append(rules, splitRule{pattern: fields[0], server: fields[1]})
+	}
+	return rules, scanner.Err()
+}
+
+// initSplitRules loads -dns-rules and reloads it on SIGHUP
+func initSplitRules() error {
+	if *splitRulesPath == "" {
+		return nil
+	}
+	rules, err := loadSplitRules(*splitRulesPath)
+	if err != nil {
+		return err
+	}
+	currentSplitRules.Store(rules)
+	l.Printf("loaded %d DNS rules from %s", len(rules), *splitRulesPath)
+
+	onReload("DNS rules", func() error {
+		rules, err := loadSplitRules(*splitRulesPath)
+		if err != nil {
+			return err
+		}
+		currentSplitRules.Store(rules)
+		l.Printf("reloaded %d DNS rules from %s", len(rules), *splitRulesPath)
+		return nil
+	})
+	return nil
+}
+
+// splitResolver returns the resolver for the first rule matching name, nil if none match
+func splitResolver(name string) *net.Resolver {
+	rules := staticSplitRules
+	if loaded, ok := currentSplitRules.Load().(splitRules); ok {
+		rules = append(rules[:len(rules):len(rules)], loaded...)
+	}
+	for _, rule := range rules {
+		if matchDomain(rule.pattern, name) {
+			v("resolving %q with %s", name, rule.server)
+			splitResolversMu.Lock()
+			defer splitResolversMu.Unlock()
+			r, ok := splitResolvers[rule.server]
+			if !ok {
+				r = upstreamResolver(rule.server)
+				splitResolvers[rule.server] = r
+			}
+			return r
+		}
+	}
+	return nil
+}
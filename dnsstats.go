@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+)
+
+// maxFailureDomains bounds the number of domains failures are counted for individually
+const maxFailureDomains = 1000
+
+var (
+	// dnsFailures counts resolution failures by domain, domains past maxFailureDomains are counted as "(other)"
+	dnsFailures = expvar.NewMap("dns_failures")
+	// dnsFailureKinds counts resolution failures by kind
+	dnsFailureKinds = expvar.NewMap("dns_failure_kinds")
+
+	failureDomainsMu sync.Mutex
+	failureDomains   int
+)
+
+// recordDNSFailure counts a failure of kind to resolve name
+func recordDNSFailure(name, kind string) {
+	key := dnsKey(name)
+	failureDomainsMu.Lock()
+	if dnsFailures.Get(key) == nil {
+		if failureDomains >= maxFailureDomains {
+			key = "(other)"
+		} else {
+			failureDomains++
+		}
+	}
+	failureDomainsMu.Unlock()
+	dnsFailures.Add(key, 1)
+	dnsFailureKinds.Add(kind, 1)
+}
+
+// dnsErrorKind classifies a lookup error for dnsFailureKinds
+func dnsErrorKind(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case !errors.As(err, &dnsErr):
+		return "other"
+	case dnsErr.IsNotFound:
+		return "nxdomain"
+	case dnsErr.IsTimeout:
+		return "timeout"
+	case dnsErr.IsTemporary:
+		return "servfail"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	// dohClient is used for DNS over HTTPS requests from the host's own address so connections to the server are reused
+	dohClient = &http.Client{Transport: dohTransport(false)}
+	// dohEgressClient is used for requests from egress addresses, connecting for each so the address changes every time
+	dohEgressClient = &http.Client{Transport: dohTransport(true)}
+)
+
+// dohTransport returns the default transport connecting to the server with dialDNS
+func dohTransport(disableKeepAlives bool) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialDNS
+	t.DisableKeepAlives = disableKeepAlives
+	return t
+}
+
+// dohConn is a net.Conn that sends DNS over TCP framed queries as DNS over HTTPS requests (RFC 8484)
+// the Go resolver treats any non packet connection as TCP, so it needs no other changes
+type dohConn struct {
+	ctx      context.Context
+	url      string
+	query    bytes.Buffer
+	reply    bytes.Buffer
+	deadline time.Time
+}
+
+// dohAddr is the placeholder address of a dohConn
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+// newDoHConn returns a connection sending queries to url
+func newDoHConn(ctx context.Context, url string) *dohConn {
+	return &dohConn{ctx: ctx, url: url}
+}
+
+// Write buffers the query and sends it once a complete length prefixed message has been written
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	if c.query.Len() < 2 {
+		return len(b), nil
+	}
+	msgLen := int(binary.BigEndian.Uint16(c.query.Bytes()))
+	if c.query.Len() < 2+msgLen {
+		return len(b), nil
+	}
+	msg := c.query.Next(2 + msgLen)[2:]
+	reply, err := c.roundTrip(msg)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) > 0xffff {
+		return 0, errors.New("DoH reply too large")
+	}
+	var prefix [2]byte
+	binary.BigEndian.PutUint16(prefix[:], uint16(len(reply)))
+	c.reply.Write(prefix[:])
+	c.reply.Write(reply)
+	return len(b), nil
+}
+
+// roundTrip POSTs msg to the server and returns the DNS message in the response
+func (c *dohConn) roundTrip(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	client := dohClient
+	if dnsSource != nil || ctx.Value(dnsSourceKey{}) != nil {
+		client = dohEgressClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server %s returned %s", c.url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 0xffff+1))
+}
+
+// Read returns the buffered replies
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.reply.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.reply.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr("") }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
@@ -8,6 +8,9 @@ import (
 	"syscall"
 )
 
+// freebindSupported is true when any address can be used as a source without being assigned to an interface
+const freebindSupported = true
+
 func controlFreebind(network, address string, c syscall.RawConn) error {
 	if err := freeBind(network, address, c); err != nil {
 		return err
@@ -19,12 +22,13 @@ func controlFreebind(network, address string, c syscall.RawConn) error {
 func freeBind(network, address string, c syscall.RawConn) error {
 	var err, sockErr error
 	err = c.Control(func(fd uintptr) {
-		if network == "tcp6" {
+		switch network {
+		case "tcp6", "udp6":
 			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_BINDANY, 1)
-		} else if network == "tcp4" {
+		case "tcp4", "udp4":
 			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BINDANY, 1)
-		} else {
-			sockErr = fmt.Errorf("expecting 'tcp6' or 'tcp4', got %q", network)
+		default:
+			sockErr = fmt.Errorf("expecting tcp4, tcp6, udp4 or udp6, got %q", network)
 		}
 	})
 	if err != nil {
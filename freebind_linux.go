@@ -5,6 +5,9 @@ package main
 
 import "syscall"
 
+// freebindSupported is true when any address can be used as a source without being assigned to an interface
+const freebindSupported = true
+
 func controlFreebind(network, address string, c syscall.RawConn) error {
 	if err := freeBind(network, address, c); err != nil {
 		return err
@@ -5,5 +5,11 @@ package main
 
 import "syscall"
 
-// leave nil
-var controlFreebind func(network, address string, c syscall.RawConn) error = nil
+// freebindSupported is true when any address can be used as a source without being assigned to an interface
+// without it only addresses already assigned to local interfaces can be used
+const freebindSupported = false
+
+// controlFreebind is a no-op, freebind is not supported on this platform
+func controlFreebind(network, address string, c syscall.RawConn) error {
+	return nil
+}
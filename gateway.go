@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gatewayHandshakeTimeout bounds the SOCKS handshake with a gateway when the request has no deadline
+const gatewayHandshakeTimeout = 30 * time.Second
+
+// gateway is a remote SOCKS5 proxy, such as another stargate, egressing on cidr
+type gateway struct {
+	cidr *net.IPNet
+	addr string
+}
+
+// gatewayList is a flag.Value collecting -gateway entries
+type gatewayList []*gateway
+
+var gateways gatewayList
+
+func init() {
+	flag.Var(&gateways, "gateway", "also egress random proxy connections through the SOCKS5 proxy egressing on a subnet, such as a remote stargate -random proxy, as `cidr=host:port`, may be repeated")
+}
+
+// String returns the gateways in the form accepted by Set
+func (g *gatewayList) String() string {
+	entries := make([]string, 0, len(*g))
+	for _, gw := range *g {
+		entries = append(entries, gw.cidr.String()+"="+gw.addr)
+	}
+	return strings.Join(entries, ",")
+}
+
+// Set adds a gateway of the form "cidr=host:port"
+func (g *gatewayList) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid gateway %q, expected cidr=host:port", s)
+	}
+	_, cidr, err := net.ParseCIDR(s[:i])
+	if err != nil {
+		return err
+	}
+	if _, _, err := net.SplitHostPort(s[i+1:]); err != nil {
+		return err
+	}
+	*g = append(*g, &gateway{cidr: cidr, addr: s[i+1:]})
+	return nil
+}
+
+// pickGateway returns the gateway to egress a connection to dest through, nil to egress locally
+// connections are spread evenly across the local egress and the gateways in the family of dest
+func pickGateway(dest net.IP) *gateway {
+	var eligible []*gateway
+	for _, gw := range gateways {
+		if (gw.cidr.IP.To4() != nil) == (dest.To4() != nil) {
+			eligible = append(eligible, gw)
+		}
+	}
+	i := rand.Intn(len(eligible) + 1)
+	if i == len(eligible) {
+		return nil
+	}
+	return eligible[i]
+}
+
+// dial connects to addr through the gateway
+func (gw *gateway) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := connect(ctx, newDialer(nil), "tcp", gw.addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(gatewayHandshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if err := socksConnect(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("gateway %s: %w", gw.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socksReplies are the SOCKS5 reply codes (RFC 1928 section 6)
+var socksReplies = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksConnect asks the SOCKS5 server on conn to connect to addr without authentication
+func socksConnect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		return err
+	}
+	if method[0] != 5 || method[1] != 0 {
+		return errors.New("SOCKS server requires authentication")
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socksReplies) {
+			return errors.New(socksReplies[reply[1]])
+		}
+		return fmt.Errorf("SOCKS reply %d", reply[1])
+	}
+	// skip the bound address
+	var skip int
+	switch reply[3] {
+	case 1:
+		skip = net.IPv4len + 2
+	case 4:
+		skip = net.IPv6len + 2
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("SOCKS reply address type %d", reply[3])
+	}
+	_, err = io.CopyN(ioutil.Discard, conn, int64(skip))
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// listenerStatus is the state of a listener reported by /readyz
+type listenerStatus struct {
+	Name  string `json:"name"`
+	Addr  string `json:"addr"`
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	listenersMu sync.Mutex
+	listeners   = make(map[string]*listenerStatus) // by address
+)
+
+// expectListener registers a listener that is not ready until listen succeeds on addr
+// listeners are registered before they are started so /readyz does not report ready while some are still starting
+func expectListener(name, addr string) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners[addr] = &listenerStatus{Name: name, Addr: addr}
+}
+
+// setListener records the state of the listener on addr, ready if err is nil
+func setListener(addr string, err error) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	s, ok := listeners[addr]
+	if !ok {
+		return
+	}
+	s.Ready = err == nil
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// listen listens on addr and records the result for /readyz
+func listen(network, addr string) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	setListener(addr, err)
+	return ln, err
+}
+
+// errStopped is reported for listeners that stopped serving without an error
+var errStopped = errors.New("stopped")
+
+// stopped records that the listener on addr stopped serving with err
+func stopped(addr string, err error) {
+	if err == nil {
+		err = errStopped
+	}
+	setListener(addr, err)
+}
+
+// readiness is the /readyz response
+type readiness struct {
+	Ready     bool              `json:"ready"`
+	Listeners int               `json:"listeners"`
+	Listening int               `json:"listening"`
+	NotReady  []*listenerStatus `json:"not_ready,omitempty"`
+}
+
+// handleHealthz reports that the process is up
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether every listener is up, with 503 if any is not
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	listenersMu.Lock()
+	res := readiness{Listeners: len(listeners)}
+	for _, s := range listeners {
+		if s.Ready {
+			res.Listening++
+		} else {
+			status := *s
+			res.NotReady = append(res.NotReady, &status)
+		}
+	}
+	listenersMu.Unlock()
+	res.Ready = res.Listening == res.Listeners
+
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// hostOverrides maps names to the addresses they resolve to without DNS
+type hostOverrides map[string][]net.IP
+
+// staticHosts holds the -host entries
+var staticHosts = hostOverrides{}
+
+// currentHosts holds the hostOverrides loaded from -hosts, replaced on SIGHUP
+var currentHosts atomic.Value
+
+func init() {
+	flag.Var(&staticHosts, "host", "resolve a name to a fixed address without DNS as `name=ip`, may be repeated")
+}
+
+// String returns the entries in the form accepted by Set
+func (h *hostOverrides) String() string {
+	var entries []string
+	for name, ips := range *h {
+		for _, ip := range ips {
+			entries = append(entries, name+"="+ip.String())
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// Set adds an entry of the form "name=ip"
+func (h *hostOverrides) Set(s string) error {
+	i := strings.LastIndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid host %q, expected name=ip", s)
+	}
+	ip := net.ParseIP(s[i+1:])
+	if ip == nil {
+		return fmt.Errorf("invalid address in host %q", s)
+	}
+	h.add(s[:i], ip)
+	return nil
+}
+
+// add appends ip to the addresses of name
+func (h hostOverrides) add(name string, ip net.IP) {
+	key := dnsKey(name)
+	h[key] = append(h[key], ip)
+}
+
+// loadHosts reads a hosts file, each line an address followed by the names resolving to it
+func loadHosts(path string) (hostOverrides, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := hostOverrides{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"ADDRESS NAME...\", got %q", path, lineNum, strings.Join(fields, " "))
+		}
+		for _, name := range fields[1:] {
+			h.add(name, ip)
+		}
+	}
+	return h, scanner.Err()
+}
+
+// initHosts loads -hosts and reloads it on SIGHUP
+func initHosts() error {
+	if *hostsPath == "" {
+		return nil
+	}
+	h, err := loadHosts(*hostsPath)
+	if err != nil {
+		return err
+	}
+	currentHosts.Store(h)
+	l.Printf("loaded %d hosts from %s", len(h), *hostsPath)
+
+	onReload("hosts", func() error {
+		h, err := loadHosts(*hostsPath)
+		if err != nil {
+			return err
+		}
+		currentHosts.Store(h)
+		l.Printf("reloaded %d hosts from %s", len(h), *hostsPath)
+		return nil
+	})
+	return nil
+}
+
+// staticAddrs returns the overridden addresses of name, -host entries taking precedence over -hosts
+func staticAddrs(name string) []net.IPAddr {
+	key := dnsKey(name)
+	ips, ok := staticHosts[key]
+	if !ok {
+		if h, loaded := currentHosts.Load().(hostOverrides); loaded {
+			ips, ok = h[key]
+		}
+	}
+	if !ok {
+		return nil
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// logLevel is the severity of a log message
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// loggers for each level, l is info
+var (
+	l        = log.New(logWriter(levelInfo), "", log.LstdFlags)
+	debugLog = log.New(logWriter(levelDebug), "", log.LstdFlags)
+	warnLog  = log.New(logWriter(levelWarn), "", log.LstdFlags)
+	errorLog = log.New(logWriter(levelError), "", log.LstdFlags)
+)
+
+// minLogLevel is the parsed -log-level, messages below it are dropped
+var minLogLevel = levelInfo
+
+// initLogging applies -log-level, -verbose and -log-format
+// nothing is changed if either is invalid, so the error is still logged
+func initLogging() error {
+	level := logLevel(-1)
+	for i, name := range levelNames {
+		if name == *logLevelName {
+			level = logLevel(i)
+		}
+	}
+	if level < 0 {
+		return fmt.Errorf("invalid -log-level %q, expected one of %s", *logLevelName, strings.Join(levelNames, ", "))
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		return fmt.Errorf("invalid -log-format %q, expected text or json", *logFormat)
+	}
+	if *verbose {
+		level = levelDebug
+	}
+	minLogLevel = level
+	if *logFormat == "json" {
+		// the time is added as a field instead
+		for _, logger := range []*log.Logger{l, debugLog, warnLog, errorLog} {
+			logger.SetFlags(0)
+		}
+	}
+	return nil
+}
+
+// logWriter writes the messages of a logger at its level to stderr
+type logWriter logLevel
+
+// Write writes a single message from a log.Logger if its level is enabled
+func (w logWriter) Write(p []byte) (int, error) {
+	if logLevel(w) < minLogLevel {
+		return len(p), nil
+	}
+	if *logFormat != "json" {
+		return os.Stderr.Write(p)
+	}
+	if err := writeJSONLog(logLevel(w), strings.TrimSuffix(string(p), "\n"), nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeJSONLog writes a message in -log-format json, with the key value pairs in fields as extra fields
+func writeJSONLog(level logLevel, msg string, fields []string) error {
+	rec := map[string]string{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": levelNames[level],
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		rec[fields[i]] = fields[i+1]
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stderr.Write(append(line, '\n'))
+	return err
+}
+
+// v logs at debug level
+func v(format string, a ...interface{}) {
+	if minLogLevel <= levelDebug {
+		debugLog.Printf(format, a...)
+	}
+}
+
+// vFields logs msg at debug level with key value pairs, which are separate fields with -log-format json
+func vFields(msg string, fields ...string) {
+	if minLogLevel > levelDebug {
+		return
+	}
+	if *logFormat == "json" {
+		writeJSONLog(levelDebug, msg, fields)
+		return
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		msg += " " + fields[i] + "=" + fields[i+1]
+	}
+	debugLog.Print(msg)
+}
+
+// warnf logs a problem stargate carries on after
+func warnf(format string, a ...interface{}) {
+	if *logFormat == "text" {
+		format = "warning: " + format
+	}
+	warnLog.Printf(format, a...)
+}
+
+// errorf logs a failed operation
+func errorf(format string, a ...interface{}) {
+	errorLog.Printf(format, a...)
+}
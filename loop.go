@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+
+	"github.com/haxii/socks5"
+)
+
+// addresses connections are refused to because they would loop back into stargate
+var (
+	loopEgress []*net.IPNet // the egress addresses
+	loopIPs    []net.IP     // addresses the proxies listen on
+	loopPorts  portRange    // ports of the sequential proxies
+	loopRandom int          // port of the random proxy
+)
+
+// initLoopGuard records the addresses stargate listens on and egresses from
+// loopPorts is set separately once the number of sequential proxies is known
+func initLoopGuard(egress []*net.IPNet) error {
+	loopEgress = append(loopEgress, egress...)
+	loopRandom = int(*random)
+
+	ip := net.ParseIP(*listenIP)
+	if *listenIP != "" && (ip == nil || !ip.IsUnspecified()) {
+		ips, err := net.LookupIP(*listenIP)
+		if err != nil {
+			return err
+		}
+		loopIPs = ips
+		return nil
+	}
+	// listening on all addresses
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			loopIPs = append(loopIPs, ipNet.IP)
+		}
+	}
+	return nil
+}
+
+// isLoop returns true if connecting to addr would connect back to this proxy
+func isLoop(addr *socks5.AddrSpec) bool {
+	if addr.IP == nil {
+		return false
+	}
+	for _, n := range loopEgress {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	listenPort := addr.Port == loopRandom || (loopPorts.max != 0 && addr.Port >= int(loopPorts.min) && addr.Port <= int(loopPorts.max))
+	if !listenPort {
+		return false
+	}
+	for _, ip := range loopIPs {
+		if ip.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,12 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"math"
 	"math/big"
 	"math/rand"
 	"net"
 	"os"
+	"runtime"
 	"strconv"
 	"time"
 
@@ -21,74 +21,167 @@ var (
 	listenIP = flag.String("listen", "localhost", "IP to listen on")
 	port     = flag.Uint("port", 0, "first port to start listening on")
 	random   = flag.Uint("random", 0, "port to use for random proxy server")
-	verbose  = flag.Bool("verbose", false, "enable verbose logging")
+	auto     = flag.String("auto", "", "interface to pick the egress subnet from when no CIDR is given")
+	iface    = flag.String("iface", "", "interface whose global addresses to egress on when no CIDR is given")
+	verbose  = flag.Bool("verbose", false, "enable verbose logging, the same as -log-level debug")
+
+	logLevelName = flag.String("log-level", "info", "minimum level of messages to log: debug, info, warn or error")
+	logFormat    = flag.String("log-format", "text", "format of log messages: text, or json for one object per line")
+
+	dnsServer      = flag.String("dns", "", "DNS server to resolve destinations with instead of the system resolver, as host[:port], tls://host[:port] or an https:// DoH URL, or a comma separated list of them to rotate through")
+	dnsTimeout     = flag.Duration("dns-timeout", 0, "timeout for each DNS lookup attempt, 0 for the resolver default")
+	dnsRetries     = flag.Int("dns-retries", 0, "number of times to retry DNS lookups that timed out or failed on the server")
+	dnsCacheSize   = flag.Int("dns-cache", 0, "number of DNS lookups to cache for the TTL of their records, 0 to disable")
+	dnsCacheMaxTTL = flag.Duration("dns-cache-max-ttl", time.Hour, "longest time to cache a DNS lookup for")
+	dnsNegativeTTL = flag.Duration("dns-negative-ttl", 0, "time to cache names the DNS server answered with NXDOMAIN or SERVFAIL for, 0 to disable")
+	dnsOrder       = flag.String("dns-order", "", "comma separated address families (ip4, ip6) to prefer in order when the -iface random proxy egresses on both")
+	splitRulesPath = flag.String("dns-rules", "", "file of PATTERN SERVER lines resolving matching names with another DNS server, reloaded on SIGHUP")
+	hostsPath      = flag.String("hosts", "", "hosts file of addresses to resolve names to without DNS, reloaded on SIGHUP")
+	dnsListen      = flag.String("dns-listen", "", "address to run a DNS forwarder on, sending queries upstream from random egress addresses")
+	dnsECS         = flag.String("dns-ecs", "", "EDNS Client Subnet handling in the DNS forwarder: \"strip\" to remove it from queries, \"egress\" to replace it with the egress network, empty to pass it through")
+	dnssec         = flag.Bool("dnssec", false, "reject DNS answers the server did not authenticate with the AD bit, including those of unsigned domains; only use with a trusted validating server, ideally over TLS or HTTPS")
+	dnsEgress      = flag.Bool("dns-egress", false, "send DNS queries from random egress addresses instead of the host's own, refusing servers no egress address can reach")
+
+	dialTimeout = flag.Duration("dial-timeout", 0, "timeout for outbound connections, 0 for the OS default")
+	keepAlive   = flag.Duration("keepalive", 0, "TCP keepalive interval for outbound connections, 0 for the Go default, negative to disable")
+	noDelay     = flag.Bool("nodelay", true, "set TCP_NODELAY on outbound connections")
+	linger      = flag.Int("linger", -1, "SO_LINGER seconds for outbound connections, negative for the OS default")
+	fwmark      = flag.Uint("fwmark", 0, "SO_MARK to set on outbound connections for policy routing (linux only)")
+	egressIface = flag.String("egress-iface", "", "interface to bind outbound connections to with SO_BINDTODEVICE (linux only)")
+	vrf         = flag.String("vrf", "", "VRF device to place outbound connections in (linux only)")
+	dscp        = flag.Uint("dscp", 0, "DSCP value (0-63) to set in the TOS/traffic class of outbound connections (linux only)")
+	fastOpen    = flag.Bool("tfo", false, "enable TCP Fast Open on outbound connections (linux only)")
+	mptcp       = flag.Bool("mptcp", false, "use MPTCP for outbound connections when supported by the kernel")
+	netns       = flag.String("netns", "", "network namespace name or path to make outbound connections from (linux only)")
+	anyIPRoute  = flag.Bool("anyip-route", false, "add a local route for the subnet on the loopback interface while running (linux only)")
+	strictRoute = flag.Bool("strict-route", false, "exit instead of warning when no local route covers the subnet (linux only)")
+	ndpProxy    = flag.String("ndp-proxy", "", "interface to answer neighbor solicitations for the IPv6 subnet on (linux only)")
+	arpProxy    = flag.String("arp-proxy", "", "interface to answer ARP requests for the IPv4 subnet on (linux only)")
+	aliasIface  = flag.String("alias-iface", "", "interface to assign the subnet addresses to as aliases while running (darwin only)")
+
+	connRateUp   = flag.Uint64("conn-rate-up", 0, "maximum bytes per second each connection may send upstream, 0 for unlimited")
+	connRateDown = flag.Uint64("conn-rate-down", 0, "maximum bytes per second each connection may receive from upstream, 0 for unlimited")
+	rateUp       = flag.Uint64("rate-up", 0, "maximum bytes per second sent upstream by all connections combined, 0 for unlimited")
+	rateDown     = flag.Uint64("rate-down", 0, "maximum bytes per second received from upstream by all connections combined, 0 for unlimited")
+	idleTimeout  = flag.Duration("idle-timeout", 0, "close connections with no traffic in either direction for this long, 0 to disable")
+	maxLifetime  = flag.Duration("max-lifetime", 0, "close connections open for longer than this, 0 to disable")
+
+	aclFile      = flag.String("acl", "", "file of destination allow/deny rules, reloaded on SIGHUP")
+	allowPrivate = flag.Bool("allow-private", false, "allow connections to private, loopback and link-local destinations not allowed by an address rule in -acl")
+
+	auditPath    = flag.String("audit-log", "", "file to append a JSON line to for every proxied or refused connection, reopened on SIGHUP")
+	auditMaxSize = flag.Int64("audit-log-size", 100, "megabytes after which the audit log is rotated, 0 to never rotate")
+	auditKeep    = flag.Int("audit-log-keep", 5, "number of rotated audit logs to keep")
+	debugListen  = flag.String("debug-listen", "", "address to serve pprof profiles at /debug/pprof/ and expvar variables at /debug/vars on; unauthenticated, so keep it private")
+	adminListen  = flag.String("admin-listen", "", "address to serve the admin API on, with per egress statistics at /stats and health checks at /healthz and /readyz; unauthenticated, so keep it private")
 )
 
 var (
-	l        = log.New(os.Stderr, "", log.LstdFlags)
-	resolver socks5.NameResolver
+	resolver    socks5.NameResolver
+	sourcePorts portRange
 )
 
+func init() {
+	flag.Var(&sourcePorts, "source-ports", "pick outbound source ports at random from the `min-max` range")
+}
+
 const (
 	maxProxies = 10000
 )
 
 func main() {
 	flag.Parse()
-	if flag.NArg() != 1 {
+	if err := initLogging(); err != nil {
+		errorLog.Fatal(err)
+	}
+	rand.Seed(time.Now().Unix())
+	handleSignals()
+	if flag.NArg() != 1 && !(flag.NArg() == 0 && (*auto != "" || *iface != "")) {
 		flag.Usage = func() {
-			fmt.Fprintf(os.Stderr, "Usage of %s: [OPTION]... CIDR\n\tCIDR example: \"192.0.2.0/24\"\nOPTIONS:\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Usage of %s: [OPTION]... CIDR\n\tCIDR example: \"192.0.2.0/24\"\n\tCIDR may be omitted when -auto or -iface is set\nOPTIONS:\n", os.Args[0])
 			flag.PrintDefaults()
 		}
 		flag.Usage()
 		return
 	}
-	proxy := flag.Arg(0)
 
-	if *port == 0 && *random == 0 {
-		l.Fatal("no SOCKS proxy ports provided, pass -port and/or -random")
+	if *port == 0 && *random == 0 && *dnsListen == "" {
+		errorLog.Fatal("no SOCKS proxy ports provided, pass -port and/or -random, or -dns-listen")
 	}
-
-	_, cidr, err := net.ParseCIDR(proxy)
-	check(err)
-
-	// calculate number of proxies about to start
-	// show warning if too large
-	subnetSize := maskSize(&cidr.Mask)
-	v("subnet size %s", subnetSize.String())
-
-	// prep network aware resolver
-	resolver = &DNSResolver{
-		network: getIPNetwork(&cidr.IP),
+	if *iface != "" && (flag.NArg() != 0 || *auto != "") {
+		errorLog.Fatal("-iface can not be used with a CIDR or -auto")
+	}
+	if *iface != "" && (*anyIPRoute || *aliasIface != "" || *ndpProxy != "" || *arpProxy != "") {
+		errorLog.Fatal("-iface can not be used with -anyip-route, -alias-iface, -ndp-proxy or -arp-proxy")
+	}
+	if *dnsECS != "" && *dnsECS != "strip" && *dnsECS != "egress" {
+		errorLog.Fatalf("invalid -dns-ecs %q, expected strip or egress", *dnsECS)
 	}
+	check(checkMPTCP())
+	check(openNetns())
+	check(checkSockopts())
+	initRateLimits()
+	initDNSCache()
+	check(initDNSOrder())
+	check(initHosts())
+	check(initSplitRules())
+	check(initACL())
+	check(initAudit())
 
 	var work errgroup.Group
-	if *port != 0 {
-		// show warning if subnet too large
-		if subnetSize.Cmp(big.NewInt(math.MaxInt32)) > 0 {
-			l.Fatalf("proxy range provided larger than MaxInt32")
+	var ipList []net.IP               // addresses for the sequential proxies
+	var assigned map[string]bool      // if set, addresses in ipList that may be used
+	var pick func(dest net.IP) net.IP // address for each random proxy connection
+	if *iface != "" {
+		var err error
+		ipList, err = interfaceIPs(*iface)
+		check(err)
+		l.Printf("egressing on the %d global addresses of %s", len(ipList), *iface)
+		check(initLoopGuard(hostNets(ipList)))
+		resolver = newResolver(listNetwork(ipList))
+		pick = func(dest net.IP) net.IP {
+			return pickFamily(ipList, dest)
 		}
-		if subnetSize.Cmp(big.NewInt(maxProxies)) > 0 {
-			l.Fatalf("proxy range provided too large %s > %d", subnetSize.String(), maxProxies)
+	} else {
+		var cidr *net.IPNet
+		var err error
+		if flag.NArg() == 0 {
+			cidr, err = autoCIDR(*auto)
+			check(err)
+			l.Printf("using %s from %s", cidr.String(), *auto)
+		} else {
+			_, cidr, err = net.ParseCIDR(flag.Arg(0))
+			check(err)
 		}
+		ipList, assigned, pick = setupSubnet(cidr, &work)
+	}
+	if *dnsEgress || *dnsListen != "" {
+		check(checkDNSEgress(pick))
+	}
+	if *dnsEgress {
+		dnsSource = pick
+	}
 
-		ipList, err := hosts(cidr)
-		check(err)
-
+	if *port != 0 {
 		// check that random port is outside range of other proxies
 		if *random != 0 && *random >= *port && int(*random) < (int(*port)+len(ipList)) {
-			l.Fatalf("random port %d inside range %d-%d", *random, *port, int(*port)+len(ipList))
+			check(fmt.Errorf("random port %d inside range %d-%d", *random, *port, int(*port)+len(ipList)))
 		}
 
-		l.Printf("starting on %s\n", cidr.String())
+		loopPorts = portRange{min: uint16(*port), max: uint16(int(*port) + len(ipList) - 1)}
 		started := 0
 		for num, ip := range ipList {
 			listenPort := num + int(*port)
 			ip := ip // https://golang.org/doc/faq#closures_and_goroutines
+			if assigned != nil && !assigned[ip.String()] {
+				v("skipping %s, not assigned to a local interface", ip.String())
+				continue
+			}
 			started++
 
 			addrStr := net.JoinHostPort(*listenIP, strconv.Itoa(listenPort))
 			l.Printf("Starting proxy %s using IP: %s\n", addrStr, ip.String())
+			expectListener("proxy "+ip.String(), addrStr)
 			work.Go(func() error {
 				return runProxy(ip, addrStr)
 			})
@@ -98,28 +191,123 @@ func main() {
 
 	// start random proxy if -random set
 	if *random != 0 {
-		rand.Seed(time.Now().Unix())
+		addrStr := net.JoinHostPort(*listenIP, strconv.Itoa(int(*random)))
+		expectListener("random proxy", addrStr)
 		work.Go(func() error {
-			addrStr := net.JoinHostPort(*listenIP, strconv.Itoa(int(*random)))
 			l.Printf("Starting random egress proxy %s\n", addrStr)
-			return runRandomProxy(cidr, addrStr)
+			return runRandomProxy(pick, addrStr)
+		})
+	}
+
+	if *dnsListen != "" {
+		expectListener("DNS forwarder", *dnsListen)
+		work.Go(func() error {
+			return runDNSForwarder(*dnsListen, pick)
+		})
+	}
+
+	if *adminListen != "" {
+		work.Go(func() error {
+			return runAdmin(*adminListen)
+		})
+	}
+	if *debugListen != "" {
+		work.Go(func() error {
+			return runDebug(*debugListen)
 		})
 	}
 
-	err = work.Wait()
+	err := work.Wait()
 	check(err)
 }
 
-// check checks errors
-func check(err error) {
-	if err != nil {
-		l.Fatal(err)
+// setupSubnet prepares egressing on cidr, starting any helpers for it in work
+// it returns the addresses for the sequential proxies if -port is set, the subset of them that may be used if
+// restricted, and the function choosing the address for each random proxy connection
+func setupSubnet(cidr *net.IPNet, work *errgroup.Group) ([]net.IP, map[string]bool, func(net.IP) net.IP) {
+	// calculate number of proxies about to start
+	// show warning if too large
+	subnetSize := maskSize(&cidr.Mask)
+	v("subnet size %s", subnetSize.String())
+
+	// validate before installing routes or aliases that would need cleaning up
+	if *port != 0 && subnetSize.Cmp(big.NewInt(math.MaxInt32)) > 0 {
+		errorLog.Fatalf("proxy range provided larger than MaxInt32")
+	}
+	if *port != 0 && subnetSize.Cmp(big.NewInt(maxProxies)) > 0 {
+		errorLog.Fatalf("proxy range provided too large %s > %d", subnetSize.String(), maxProxies)
+	}
+	if *aliasIface != "" && subnetSize.Cmp(big.NewInt(maxProxies)) > 0 {
+		errorLog.Fatalf("proxy range provided too large to alias %s > %d", subnetSize.String(), maxProxies)
+	}
+
+	check(initLoopGuard([]*net.IPNet{cidr}))
+
+	if *anyIPRoute {
+		check(installAnyIPRoute(cidr))
+	}
+	if freebindSupported {
+		if err := checkLocalRoute(cidr); err != nil {
+			if *strictRoute {
+				check(err)
+			}
+			warnf("%s", err)
+		}
+	}
+	if *aliasIface != "" {
+		ipList, err := hosts(cidr)
+		check(err)
+		check(addAliases(*aliasIface, ipList))
+	}
+
+	// without freebind only addresses assigned to this host can be used
+	pick := func(net.IP) net.IP {
+		return randomIP(cidr)
 	}
+	var assigned map[string]bool
+	if !freebindSupported {
+		local, err := localAddrsIn(cidr)
+		check(err)
+		if len(local) == 0 {
+			check(fmt.Errorf("freebind is not supported on %s and no addresses in %s are assigned to local interfaces", runtime.GOOS, cidr.String()))
+		}
+		l.Printf("freebind is not supported on %s, egressing only on the %d addresses in %s assigned to local interfaces", runtime.GOOS, len(local), cidr.String())
+		assigned = make(map[string]bool, len(local))
+		for _, ip := range local {
+			assigned[ip.String()] = true
+		}
+		pick = func(net.IP) net.IP {
+			return local[rand.Intn(len(local))]
+		}
+	}
+
+	// prep network aware resolver
+	resolver = newResolver(getIPNetwork(&cidr.IP))
+
+	if *ndpProxy != "" {
+		work.Go(func() error {
+			return runNDPProxy(*ndpProxy, cidr)
+		})
+	}
+	if *arpProxy != "" {
+		work.Go(func() error {
+			return runARPProxy(*arpProxy, cidr)
+		})
+	}
+
+	if *port == 0 {
+		return nil, assigned, pick
+	}
+	ipList, err := hosts(cidr)
+	check(err)
+	l.Printf("starting on %s\n", cidr.String())
+	return ipList, assigned, pick
 }
 
-// v verbose logging
-func v(format string, a ...interface{}) {
-	if *verbose {
-		l.Printf(format, a...)
+// check checks errors
+func check(err error) {
+	if err != nil {
+		runCleanup()
+		errorLog.Fatal(err)
 	}
 }
@@ -0,0 +1,18 @@
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import "net"
+
+// checkMPTCP returns an error if -mptcp can not be honored by this build
+func checkMPTCP() error {
+	return nil
+}
+
+// setMPTCP enables MPTCP on d if requested, falling back to TCP when the kernel does not support it
+func setMPTCP(d *net.Dialer) {
+	if *mptcp {
+		d.SetMultipathTCP(true)
+	}
+}
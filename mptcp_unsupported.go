@@ -0,0 +1,20 @@
+//go:build !go1.21
+// +build !go1.21
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// checkMPTCP returns an error if -mptcp can not be honored by this build
+func checkMPTCP() error {
+	if *mptcp {
+		return errors.New("-mptcp requires stargate to be built with go1.21 or newer")
+	}
+	return nil
+}
+
+// setMPTCP is a no-op, MPTCP is not supported by this build
+func setMPTCP(d *net.Dialer) {}
@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// offsets into an ethernet frame carrying an IPv6 neighbor solicitation
+const (
+	ethHeaderLen  = 14
+	ipv6HeaderLen = 40
+	icmpv6Offset  = ethHeaderLen + ipv6HeaderLen
+	nsTargetStart = icmpv6Offset + 8
+	nsMinLen      = nsTargetStart + net.IPv6len
+)
+
+// runNDPProxy answers neighbor solicitations received on iface for any address in cidr with the
+// interface's MAC address, so upstream routers that expect the prefix to be on-link deliver its traffic here
+func runNDPProxy(iface string, cidr *net.IPNet) error {
+	if cidr.IP.To4() != nil {
+		return errors.New("-ndp-proxy requires an IPv6 subnet")
+	}
+	conn, err := listenPacket(iface, syscall.ETH_P_IPV6, true)
+	if err != nil {
+		return err
+	}
+	l.Printf("answering neighbor solicitations for %s on %s", cidr.String(), iface)
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.read(buf)
+		if err != nil {
+			return err
+		}
+		frame := buf[:n]
+		if len(frame) < nsMinLen ||
+			frame[ethHeaderLen]>>4 != 6 || // IPv6
+			frame[ethHeaderLen+6] != syscall.IPPROTO_ICMPV6 || // next header
+			frame[ethHeaderLen+7] != 255 || // hop limit required by RFC 4861
+			frame[icmpv6Offset] != 135 { // neighbor solicitation
+			continue
+		}
+		src := net.IP(frame[ethHeaderLen+8 : ethHeaderLen+24])
+		target := net.IP(frame[nsTargetStart:nsMinLen])
+		if src.IsUnspecified() || !cidr.Contains(target) {
+			// duplicate address detection or not ours
+			continue
+		}
+		v("answering neighbor solicitation from %s for %s", src.String(), target.String())
+		if err := conn.write(neighborAdvert(conn.iface.HardwareAddr, frame[6:12], target, src)); err != nil {
+			errorf("neighbor advertisement for %s: %s", target.String(), err)
+		}
+	}
+}
+
+// neighborAdvert builds an ethernet frame holding a solicited neighbor advertisement for target sent to dst
+func neighborAdvert(srcMAC, dstMAC net.HardwareAddr, target, dst net.IP) []byte {
+	const icmpLen = 32 // header, flags, target and target link-layer address option
+	frame := make([]byte, icmpv6Offset+icmpLen)
+
+	copy(frame[0:6], dstMAC)
+	copy(frame[6:12], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], syscall.ETH_P_IPV6)
+
+	ip := frame[ethHeaderLen:icmpv6Offset]
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:6], icmpLen)
+	ip[6] = syscall.IPPROTO_ICMPV6
+	ip[7] = 255
+	copy(ip[8:24], target)
+	copy(ip[24:40], dst)
+
+	icmp := frame[icmpv6Offset:]
+	icmp[0] = 136  // neighbor advertisement
+	icmp[4] = 0x60 // solicited and override flags
+	copy(icmp[8:24], target)
+	icmp[24] = 2 // target link-layer address option
+	icmp[25] = 1 // option length in units of 8 bytes
+	copy(icmp[26:32], srcMAC)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(target, dst, icmp))
+	return frame
+}
+
+// icmpv6Checksum computes the ICMPv6 checksum of msg including the IPv6 pseudo-header
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src.To16())
+	add(dst.To16())
+	sum += uint32(len(msg))
+	sum += syscall.IPPROTO_ICMPV6
+	add(msg)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
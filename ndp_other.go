@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// runNDPProxy is not supported on this platform
+func runNDPProxy(iface string, cidr *net.IPNet) error {
+	return errors.New("-ndp-proxy is only supported on linux")
+}
@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// sysSetns is the setns syscall number for this architecture, the frozen syscall package predates it
+var sysSetns = map[string]uintptr{
+	"386":      346,
+	"amd64":    308,
+	"arm":      375,
+	"arm64":    268,
+	"loong64":  268,
+	"mips":     4344,
+	"mipsle":   4344,
+	"mips64":   5303,
+	"mips64le": 5303,
+	"ppc64":    350,
+	"ppc64le":  350,
+	"riscv64":  268,
+	"s390x":    339,
+}[runtime.GOARCH]
+
+// egressNetns is the network namespace outbound connections are made in, nil for the current one
+var egressNetns *os.File
+
+// openNetns opens the network namespace passed with -netns
+func openNetns() error {
+	if *netns == "" {
+		return nil
+	}
+	path := *netns
+	if !strings.ContainsRune(path, '/') {
+		// named namespace created by "ip netns add"
+		path = filepath.Join("/var/run/netns", path)
+	}
+	if sysSetns == 0 {
+		return fmt.Errorf("-netns is not supported on %s", runtime.GOARCH)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("netns: %w", err)
+	}
+	egressNetns = f
+	return nil
+}
+
+// inNetns calls dial from within the egress network namespace
+// the socket is created synchronously by dial, so it stays in the namespace after switching back
+func inNetns(dial func() (net.Conn, error)) (net.Conn, error) {
+	var conn net.Conn
+	err := withNetns(func() error {
+		var err error
+		conn, err = dial()
+		return err
+	})
+	return conn, err
+}
+
+// withNetns calls fn on a thread switched into the egress network namespace
+func withNetns(fn func() error) error {
+	if egressNetns == nil {
+		return fn()
+	}
+	runtime.LockOSThread()
+	orig, err := os.Open(fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer orig.Close()
+	if err := setns(egressNetns.Fd()); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("netns: %w", err)
+	}
+	err = fn()
+	if nsErr := setns(orig.Fd()); nsErr != nil {
+		// leave the thread locked so the runtime discards it instead of reusing it in the wrong namespace
+		return fmt.Errorf("netns restore: %w", nsErr)
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// setns moves the current thread into the network namespace referred to by fd
+func setns(fd uintptr) error {
+	_, _, errno := syscall.RawSyscall(sysSetns, fd, syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
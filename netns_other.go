@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// openNetns opens the network namespace passed with -netns
+func openNetns() error {
+	if *netns != "" {
+		return errors.New("-netns is only supported on linux")
+	}
+	return nil
+}
+
+// inNetns calls dial, network namespaces are not supported on this platform
+func inNetns(dial func() (net.Conn, error)) (net.Conn, error) {
+	return dial()
+}
@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// packetConn is a raw AF_PACKET socket sending and receiving ethernet frames on a single interface
+type packetConn struct {
+	fd    int
+	iface *net.Interface
+}
+
+// packetMreq is struct packet_mreq from linux/if_packet.h, missing from the syscall package
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]uint8
+}
+
+// listenPacket opens a packet socket on the named interface receiving frames of ethertype
+// with allmulti set the interface also delivers multicast frames for groups it has not joined
+func listenPacket(name string, ethertype uint16, allmulti bool) (*packetConn, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("interface %s is not ethernet", name)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, int(htons(ethertype)))
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(ethertype),
+		Ifindex:  iface.Index,
+	})
+	if err == nil && allmulti {
+		mreq := packetMreq{ifindex: int32(iface.Index), typ: syscall.PACKET_MR_ALLMULTI}
+		err = syscall.SetsockoptString(fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP,
+			string((*[unsafe.Sizeof(mreq)]byte)(unsafe.Pointer(&mreq))[:]))
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &packetConn{fd: fd, iface: iface}, nil
+}
+
+// read reads the next frame received by the interface, skipping frames it sent
+func (p *packetConn) read(buf []byte) (int, error) {
+	for {
+		n, from, err := syscall.Recvfrom(p.fd, buf, 0)
+		if err != nil {
+			return 0, err
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		return n, nil
+	}
+}
+
+// write sends a complete ethernet frame out of the interface
+func (p *packetConn) write(frame []byte) error {
+	return syscall.Sendto(p.fd, frame, 0, &syscall.SockaddrLinklayer{Ifindex: p.iface.Index})
+}
+
+// htons converts a short from host to network byte order, a no-op on big-endian hosts
+func htons(i uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], i)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
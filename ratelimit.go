@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// buckets shared by every connection to enforce the server wide limits, nil when unlimited
+var (
+	globalUp   *tokenBucket
+	globalDown *tokenBucket
+)
+
+// initRateLimits creates the server wide buckets from flags
+func initRateLimits() {
+	if *rateUp != 0 {
+		globalUp = newTokenBucket(float64(*rateUp))
+	}
+	if *rateDown != 0 {
+		globalDown = newTokenBucket(float64(*rateDown))
+	}
+}
+
+// tokenBucket limits a rate of bytes or events, it is safe for concurrent use
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket allowing rate tokens per second with a burst of one second
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last call, b.mu must be held
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take takes n tokens if they are available without waiting
+func (b *tokenBucket) take(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// wait blocks until n bytes may be transferred
+// the tokens are taken immediately, so large transfers go into debt that later callers wait out
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// rateLimits returns the buckets limiting a new connection in each direction
+func rateLimits() (up, down []*tokenBucket) {
+	if *connRateUp != 0 {
+		up = append(up, newTokenBucket(float64(*connRateUp)))
+	}
+	if *connRateDown != 0 {
+		down = append(down, newTokenBucket(float64(*connRateDown)))
+	}
+	if globalUp != nil {
+		up = append(up, globalUp)
+	}
+	if globalDown != nil {
+		down = append(down, globalDown)
+	}
+	return up, down
+}
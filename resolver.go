@@ -2,21 +2,318 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
 )
 
-// DNSResolver uses the system DNS to resolve host names
+// DNSResolver uses the system DNS, or the server passed with -dns or matching -dns-rule, to resolve host names
 type DNSResolver struct {
-	network string
+	network  string
+	resolver *net.Resolver
 }
 
-// Resolve with but use the same address family as the binding IP
+// newResolver returns a resolver for the network's address family, "ip" for both
+func newResolver(network string) *DNSResolver {
+	return &DNSResolver{
+		network:  network,
+		resolver: upstreamResolver(*dnsServer),
+	}
+}
+
+// upstreamResolver returns a resolver sending lookups to server, the system resolver if empty
+// server may be a plain DNS server, tls://host[:port] for DNS over TLS or an https:// URL for DNS over HTTPS
+func upstreamResolver(server string) *net.Resolver {
+	if server == "" && *dnsCacheSize <= 0 && !*dnsEgress && !*dnssec {
+		return net.DefaultResolver
+	}
+	dial := dnsDialer(server)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return inspectReplies(conn), nil
+		},
+	}
+}
+
+// dnsDialer returns a function connecting to the DNS server
+// a comma separated list of servers is rotated through on every lookup attempt, or every connection outside of one
+func dnsDialer(server string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if servers := strings.Split(server, ","); len(servers) > 1 {
+		dials := make([]func(ctx context.Context, network, address string) (net.Conn, error), len(servers))
+		for i, s := range servers {
+			dials[i] = dnsDialer(strings.TrimSpace(s))
+		}
+		var next uint32
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			i, ok := ctx.Value(dnsAttemptKey{}).(uint32)
+			if !ok {
+				i = atomic.AddUint32(&next, 1)
+			}
+			return dials[i%uint32(len(dials))](ctx, network, address)
+		}
+	}
+	switch {
+	case strings.HasPrefix(server, "https://"):
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return newDoHConn(ctx, server), nil
+		}
+	case strings.HasPrefix(server, "tls://"):
+		host := withPort(strings.TrimPrefix(server, "tls://"), "853")
+		serverName, _, _ := net.SplitHostPort(host)
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialDNS(ctx, "tcp", host)
+			if err != nil {
+				return nil, err
+			}
+			// returning a stream makes the resolver use TCP framing
+			return tls.Client(conn, &tls.Config{ServerName: serverName}), nil
+		}
+	case server != "":
+		host := withPort(server, "53")
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialDNS(ctx, network, host)
+		}
+	default:
+		// the servers from the system configuration
+		return dialDNS
+	}
+}
+
+// dnsSource picks the address to send DNS queries to dest from, nil to let the OS choose
+var dnsSource func(dest net.IP) net.IP
+
+// dnsSourceKey is the context key overriding dnsSource for a query
+type dnsSourceKey struct{}
+
+// dialDNS connects to a DNS server, from an egress address if -dns-egress is set or the context says so
+// servers given by name are looked up with the system resolver and dialed from an egress address in their family,
+// local servers are dialed from the loopback address, and servers no egress address can reach are refused
+// rather than dialed from the host's own address
+func dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	source := dnsSource
+	if s, ok := ctx.Value(dnsSourceKey{}).(func(net.IP) net.IP); ok {
+		source = s
+	}
+	if source == nil {
+		return d.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dests, err := dnsServerIPs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, dest := range dests {
+		addr := net.JoinHostPort(dest.String(), port)
+		if dest.IsLoopback() {
+			return d.DialContext(ctx, network, addr)
+		}
+		src := source(dest)
+		if src == nil || getIPNetwork(&src) != getIPNetwork(&dest) {
+			continue
+		}
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: src}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: src}
+		}
+		d.Control = control
+		v("resolving with %s from %s", addr, src.String())
+		return inNetns(func() (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		})
+	}
+	return nil, fmt.Errorf("no egress address can reach DNS server %s", address)
+}
+
+// dnsServerIPs returns the addresses of a DNS server, looking it up with the system resolver if host is a name
+func dnsServerIPs(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// dnsServerHost returns the address or name of a server in any of the forms accepted by -dns
+func dnsServerHost(server string) string {
+	if strings.HasPrefix(server, "https://") {
+		u, err := url.Parse(server)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	host, _, _ := net.SplitHostPort(withPort(strings.TrimPrefix(server, "tls://"), "53"))
+	return host
+}
+
+// dnsUpstreams returns the servers from -dns, or the system configuration if it is not set
+func dnsUpstreams() ([]string, error) {
+	if *dnsServer == "" {
+		return systemNameservers()
+	}
+	servers := strings.Split(*dnsServer, ",")
+	for i := range servers {
+		servers[i] = strings.TrimSpace(servers[i])
+	}
+	return servers, nil
+}
+
+// checkDNSEgress returns an error if queries to the upstream DNS servers can not be sent from an egress address
+// returned by pick, so the problem is found at startup instead of on every query
+func checkDNSEgress(pick func(dest net.IP) net.IP) error {
+	servers, err := dnsUpstreams()
+	if err != nil {
+		return err
+	}
+	for _, server := range servers {
+		dests, err := dnsServerIPs(context.Background(), dnsServerHost(server))
+		if err != nil {
+			warnf("looking up DNS server %s: %s", server, err)
+			continue
+		}
+		reachable := false
+		for _, dest := range dests {
+			if dest.IsLoopback() {
+				warnf("DNS server %s is local, it will send queries upstream from its own address", server)
+				reachable = true
+				break
+			}
+			src := pick(dest)
+			if getIPNetwork(&src) == getIPNetwork(&dest) {
+				reachable = true
+				break
+			}
+		}
+		if !reachable {
+			return fmt.Errorf("no egress address is in the address family of DNS server %s, pass -dns with a server in the egress family", server)
+		}
+	}
+	return nil
+}
+
+// withPort adds port to host if it does not already have one
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
+
+// Resolve with but use the same address family as the binding IP, preferring the families in -dns-order when egressing on both
+// names overridden with -host or -hosts are not looked up, and names matching -dns-rule or -dns-rules are sent to their server
 func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
 	//v("resolving %q: %q", d.network, name)
-	addr, err := net.ResolveIPAddr(d.network, name)
+	addrs := staticAddrs(name)
+	var err error
+	if addrs != nil {
+		v("%q is overridden", name)
+	} else {
+		r := d.resolver
+		if split := splitResolver(name); split != nil {
+			r = split
+		}
+		if cache != nil {
+			addrs, err = cache.lookup(ctx, r, name)
+		} else {
+			addrs, err = lookupIPAddr(ctx, r, name)
+		}
+	}
 	if err != nil {
+		recordDNSFailure(name, dnsErrorKind(err))
 		return ctx, nil, err
 	}
-	v("resolved %q to %q", name, addr.IP.String())
-	return ctx, addr.IP, err
+	if len(addrs) == 0 {
+		recordDNSFailure(name, "nxdomain")
+		return ctx, nil, &net.DNSError{Err: "no addresses", Name: name, IsNotFound: true}
+	}
+	families := d.families()
+	for _, family := range families {
+		for _, addr := range addrs {
+			if family == "ip" || getIPNetwork(&addr.IP) == family {
+				v("resolved %q to %q", name, addr.IP.String())
+				return ctx, addr.IP, nil
+			}
+		}
+	}
+	recordDNSFailure(name, "family")
+	return ctx, nil, &net.DNSError{Err: "no " + strings.Join(families, " or ") + " addresses", Name: name, IsNotFound: true}
+}
+
+// dnsAttemptKey is the context key numbering lookup attempts, so every query of an attempt goes to the same server
+type dnsAttemptKey struct{}
+
+// dnsAttempts numbers lookup attempts
+var dnsAttempts uint32
+
+// lookupIPAddr looks name up with r, limiting each attempt to -dns-timeout and retrying timeouts and server
+// failures -dns-retries times
+func lookupIPAddr(ctx context.Context, r *net.Resolver, name string) ([]net.IPAddr, error) {
+	for attempt := 0; ; attempt++ {
+		attemptCtx := context.WithValue(ctx, dnsAttemptKey{}, atomic.AddUint32(&dnsAttempts, 1))
+		cancel := context.CancelFunc(func() {})
+		if *dnsTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(attemptCtx, *dnsTimeout)
+		}
+		addrs, err := r.LookupIPAddr(attemptCtx, name)
+		cancel()
+		var dnsErr *net.DNSError
+		if err == nil || attempt >= *dnsRetries || ctx.Err() != nil ||
+			!errors.As(err, &dnsErr) || !(dnsErr.IsTimeout || dnsErr.IsTemporary) {
+			return addrs, err
+		}
+		v("retrying %q after %s", name, err)
+	}
+}
+
+// dnsFamilies is the parsed -dns-order, ending with "ip" to accept any address after the preferred families
+var dnsFamilies []string
+
+// initDNSOrder parses -dns-order
+func initDNSOrder() error {
+	if *dnsOrder == "" {
+		return nil
+	}
+	if *iface == "" {
+		// with a CIDR the source address family is fixed, so an answer in another family could never be dialed
+		return errors.New("-dns-order can only be used with -iface")
+	}
+	for _, family := range strings.Split(*dnsOrder, ",") {
+		family = strings.TrimSpace(family)
+		if family != "ip4" && family != "ip6" {
+			return fmt.Errorf("invalid -dns-order family %q, expected ip4 or ip6", family)
+		}
+		dnsFamilies = append(dnsFamilies, family)
+	}
+	dnsFamilies = append(dnsFamilies, "ip")
+	return nil
+}
+
+// families returns the address families to accept in order of preference
+// only the random proxy egressing on both families can pick a source address for either
+func (d DNSResolver) families() []string {
+	if d.network != "ip" || len(dnsFamilies) == 0 {
+		return []string{d.network}
+	}
+	return dnsFamilies
 }
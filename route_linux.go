@@ -0,0 +1,195 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// installAnyIPRoute adds a local route for cidr on the loopback interface so the host accepts traffic for
+// every address in it, the equivalent of "ip route add local CIDR dev lo", and removes it again on exit
+func installAnyIPRoute(cidr *net.IPNet) error {
+	// the loopback interface is looked up in the namespace the route goes in, its index differs between them
+	var lo *net.Interface
+	err := withNetns(func() error {
+		var err error
+		if lo, err = loopbackInterface(); err != nil {
+			return err
+		}
+		return localRoute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, cidr, lo.Index)
+	})
+	if errors.Is(err, syscall.EEXIST) {
+		// not ours to remove
+		l.Printf("local route for %s already exists", cidr.String())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("adding local route for %s: %w", cidr.String(), err)
+	}
+	l.Printf("added local route for %s dev %s", cidr.String(), lo.Name)
+	onExit(func() {
+		err := withNetns(func() error {
+			return localRoute(syscall.RTM_DELROUTE, 0, cidr, lo.Index)
+		})
+		if err != nil {
+			errorf("removing local route for %s: %s", cidr.String(), err)
+			return
+		}
+		l.Printf("removed local route for %s", cidr.String())
+	})
+	return nil
+}
+
+// checkLocalRoute returns an error if no local route covers cidr, without one the host
+// drops return traffic for addresses in cidr that are not assigned to an interface
+func checkLocalRoute(cidr *net.IPNet) error {
+	var rib []byte
+	err := withNetns(func() error {
+		var err error
+		rib, err = syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return err
+	}
+	ones, bits := cidr.Mask.Size()
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		rtm := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if rtm.Type != syscall.RTN_LOCAL || int(rtm.Dst_len) > ones {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type != syscall.RTA_DST || len(attr.Value)*8 != bits {
+				continue
+			}
+			route := net.IPNet{IP: net.IP(attr.Value), Mask: net.CIDRMask(int(rtm.Dst_len), bits)}
+			if route.Contains(cidr.IP) {
+				v("found local route %s covering %s", route.String(), cidr.String())
+				return nil
+			}
+		}
+	}
+	ip := "ip"
+	if bits == 128 {
+		ip = "ip -6"
+	}
+	masked := net.IPNet{IP: cidr.IP.Mask(cidr.Mask), Mask: cidr.Mask}
+	return fmt.Errorf("no local route covers %s, return traffic will not be accepted; add one with \"%s route add local %s dev lo\" or pass -anyip-route",
+		masked.String(), ip, masked.String())
+}
+
+// loopbackInterface returns the first loopback interface
+func loopbackInterface() (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 {
+			return &ifaces[i], nil
+		}
+	}
+	return nil, errors.New("no loopback interface found")
+}
+
+// localRoute sends a route message of msgType for a host scoped local route to cidr via ifIndex
+// and waits for the kernel to acknowledge it
+func localRoute(msgType, flags uint16, cidr *net.IPNet, ifIndex int) error {
+	rtm := syscall.RtMsg{
+		Table:    syscall.RT_TABLE_LOCAL,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    syscall.RT_SCOPE_HOST,
+		Type:     syscall.RTN_LOCAL,
+	}
+	dst := cidr.IP.To4()
+	rtm.Family = syscall.AF_INET
+	if dst == nil {
+		dst = cidr.IP.To16()
+		rtm.Family = syscall.AF_INET6
+	}
+	ones, _ := cidr.Mask.Size()
+	rtm.Dst_len = uint8(ones)
+
+	oif := uint32(ifIndex)
+	body := append((*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&rtm))[:], rtAttr(syscall.RTA_DST, dst)...)
+	body = append(body, rtAttr(syscall.RTA_OIF, (*[4]byte)(unsafe.Pointer(&oif))[:])...)
+	return netlinkRequest(msgType, flags, body)
+}
+
+// rtAttr encodes a route attribute padded to the netlink alignment
+func rtAttr(attrType uint16, data []byte) []byte {
+	attr := syscall.RtAttr{
+		Len:  uint16(syscall.SizeofRtAttr + len(data)),
+		Type: attrType,
+	}
+	b := append((*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&attr))[:], data...)
+	for len(b)%syscall.NLMSG_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// netlinkRequest sends a single NETLINK_ROUTE request and returns the error from the kernel's ack
+func netlinkRequest(msgType, flags uint16, body []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return err
+	}
+
+	hdr := syscall.NlMsghdr{
+		Len:   uint32(syscall.SizeofNlMsghdr + len(body)),
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	msg := append((*[syscall.SizeofNlMsghdr]byte)(unsafe.Pointer(&hdr))[:], body...)
+	if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != hdr.Seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("short netlink ack")
+			}
+			// the ack carries a negated errno, 0 for success
+			if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// installAnyIPRoute is not supported on this platform
+func installAnyIPRoute(cidr *net.IPNet) error {
+	return errors.New("-anyip-route is only supported on linux")
+}
+
+// checkLocalRoute is a no-op, the routing table is only inspected on linux
+func checkLocalRoute(cidr *net.IPNet) error {
+	return nil
+}
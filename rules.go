@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/haxii/socks5"
+)
+
+// ruleSet is the socks5.RuleSet applied to every request after name resolution and before dialing
+type ruleSet struct{}
+
+// Allow checks req against the destination rules
+// the request is added to the context for the audit log
+func (ruleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx = context.WithValue(ctx, requestKey{}, req)
+	if isLoop(req.DestAddr) {
+		warnf("refusing request for %s: destination is this proxy", req.DestAddr)
+		auditDenied(req, "destination is this proxy")
+		return ctx, false
+	}
+	rule := aclCheck(req.DestAddr)
+	if rule != nil && !rule.allow {
+		v("ACL denied request for %s", req.DestAddr)
+		auditDenied(req, "ACL")
+		return ctx, false
+	}
+	// only a rule for the address itself allows a private destination, so "allow *" and domain rules
+	// can not be used to reach internal services, including through names resolving to them
+	if (rule == nil || rule.cidr == nil) && !*allowPrivate && isPrivate(req.DestAddr.IP) {
+		v("denied request for private destination %s", req.DestAddr)
+		auditDenied(req, "private destination")
+		return ctx, false
+	}
+	dest := destName(req.DestAddr)
+	if !destRates.allow(dest) {
+		v("rate limit exceeded for %q", dest)
+		auditDenied(req, "destination rate limit")
+		return ctx, false
+	}
+	return ctx, true
+}
+
+// privateNets are the private, loopback, link-local and otherwise reserved destinations denied by default
+var privateNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// parseCIDRs parses a list of CIDRs known to be valid
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isPrivate returns true if ip is in one of privateNets
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// destName returns the name a request was made for, or its IP if it was made by address
+func destName(addr *socks5.AddrSpec) string {
+	if addr.FQDN != "" {
+		return addr.FQDN
+	}
+	return addr.IP.String()
+}
+
+// matchDomain returns true if name matches pattern
+// patterns starting with "*." match any subdomain, other patterns must match exactly
+func matchDomain(pattern, name string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+	return name == pattern
+}
+
+// destRateRule limits new connections to destinations matching pattern
+type destRateRule struct {
+	pattern string
+	rate    string
+	bucket  *tokenBucket
+}
+
+// destRateRules is a flag.Value collecting -dest-rate rules
+type destRateRules []*destRateRule
+
+var destRates destRateRules
+
+func init() {
+	flag.Var(&destRates, "dest-rate", "limit new connections per second to matching destinations as `pattern=rate`, e.g. \"*.example.com=10\", may be repeated")
+}
+
+// String returns the rules in the form accepted by Set
+func (r *destRateRules) String() string {
+	rules := make([]string, 0, len(*r))
+	for _, rule := range *r {
+		rules = append(rules, rule.pattern+"="+rule.rate)
+	}
+	return strings.Join(rules, ",")
+}
+
+// Set adds a rule of the form "pattern=rate"
+func (r *destRateRules) Set(s string) error {
+	i := strings.LastIndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid rate rule %q, expected pattern=rate", s)
+	}
+	rate, err := strconv.ParseFloat(s[i+1:], 64)
+	if err != nil {
+		return err
+	}
+	if rate <= 0 {
+		return fmt.Errorf("invalid rate in rule %q", s)
+	}
+	*r = append(*r, &destRateRule{
+		pattern: s[:i],
+		rate:    s[i+1:],
+		bucket:  newTokenBucket(rate),
+	})
+	return nil
+}
+
+// allow returns true if a new connection to dest is within all matching rate limits
+func (r destRateRules) allow(dest string) bool {
+	for _, rule := range r {
+		if matchDomain(rule.pattern, dest) && !rule.bucket.take(1) {
+			return false
+		}
+	}
+	return true
+}
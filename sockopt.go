@@ -0,0 +1,11 @@
+package main
+
+import "syscall"
+
+// control is the socket Control function used for all outbound connections
+func control(network, address string, c syscall.RawConn) error {
+	if err := controlFreebind(network, address, c); err != nil {
+		return err
+	}
+	return setSockopts(network, address, c)
+}
@@ -0,0 +1,142 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// constants from linux/tcp.h and linux/if_link.h, missing from the syscall package
+const (
+	tcpFastOpenConnect = 30 // TCP_FASTOPEN_CONNECT
+	iflaLinkInfo       = 18 // IFLA_LINKINFO
+	iflaInfoKind       = 1  // IFLA_INFO_KIND, nested in IFLA_LINKINFO
+)
+
+// checkSockopts returns an error if a requested socket option is not supported on this platform
+func checkSockopts() error {
+	if *egressIface != "" && *vrf != "" {
+		return errors.New("-egress-iface and -vrf are mutually exclusive")
+	}
+	if *dscp > 63 {
+		return fmt.Errorf("dscp %d out of range 0-63", *dscp)
+	}
+	// the devices are looked up where the sockets bound to them are created
+	return withNetns(func() error {
+		if *egressIface != "" {
+			if _, err := net.InterfaceByName(*egressIface); err != nil {
+				return fmt.Errorf("egress interface %q: %w", *egressIface, err)
+			}
+		}
+		if *vrf != "" {
+			kind, err := linkKind(*vrf)
+			if err != nil {
+				return fmt.Errorf("vrf %q: %w", *vrf, err)
+			}
+			if kind != "vrf" {
+				// binding to any other device only restricts the egress interface, use -egress-iface for that
+				return fmt.Errorf("vrf %q is not a VRF device, use -egress-iface to bind to an interface", *vrf)
+			}
+		}
+		return nil
+	})
+}
+
+// linkKind returns the kind of the named link as reported by "ip -d link", empty for devices without one
+func linkKind(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return "", err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWLINK || len(m.Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		ifi := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+		if int(ifi.Index) != iface.Index {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return "", err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == iflaLinkInfo {
+				return nestedAttr(attr.Value, iflaInfoKind), nil
+			}
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("link %q not found", name)
+}
+
+// nestedAttr returns the value of the attribute attrType within the nested attributes b, without trailing NULs
+func nestedAttr(b []byte, attrType uint16) string {
+	for len(b) >= syscall.SizeofRtAttr {
+		attr := (*syscall.RtAttr)(unsafe.Pointer(&b[0]))
+		if int(attr.Len) < syscall.SizeofRtAttr || int(attr.Len) > len(b) {
+			return ""
+		}
+		if attr.Type == attrType {
+			return strings.TrimRight(string(b[syscall.SizeofRtAttr:attr.Len]), "\x00")
+		}
+		next := (int(attr.Len) + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+		if next > len(b) {
+			return ""
+		}
+		b = b[next:]
+	}
+	return ""
+}
+
+// bindDevice returns the device outbound sockets should be bound to, if any
+func bindDevice() string {
+	if *vrf != "" {
+		// sockets bound to a VRF device use the routing table of the VRF
+		return *vrf
+	}
+	return *egressIface
+}
+
+// setSockopts applies the socket options requested by flags to c
+func setSockopts(network, address string, c syscall.RawConn) error {
+	var err, sockErr error
+	err = c.Control(func(fd uintptr) {
+		if *fwmark != 0 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(*fwmark))
+		}
+		if dev := bindDevice(); sockErr == nil && dev != "" {
+			sockErr = syscall.BindToDevice(int(fd), dev)
+		}
+		if sockErr == nil && *dscp != 0 {
+			// DSCP is the upper 6 bits of the TOS/traffic class byte
+			if strings.HasSuffix(network, "6") {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, int(*dscp<<2))
+			} else {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, int(*dscp<<2))
+			}
+		}
+		if sockErr == nil && *fastOpen && strings.HasPrefix(network, "tcp") {
+			// connect returns immediately and the SYN is sent along with the first write
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// checkSockopts returns an error if a requested socket option is not supported on this platform
+func checkSockopts() error {
+	if *fwmark != 0 {
+		return errors.New("-fwmark is only supported on linux")
+	}
+	if *egressIface != "" {
+		return errors.New("-egress-iface is only supported on linux")
+	}
+	if *dscp != 0 {
+		return errors.New("-dscp is only supported on linux")
+	}
+	if *fastOpen {
+		return errors.New("-tfo is only supported on linux")
+	}
+	if *vrf != "" {
+		return errors.New("-vrf is only supported on linux")
+	}
+	return nil
+}
+
+// setSockopts applies the socket options requested by flags to c
+func setSockopts(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"net"
+	"strconv"
 
 	"github.com/haxii/socks5"
 )
@@ -15,43 +16,118 @@ func runProxy(proxyIP net.IP, listenAddr string) error {
 	}
 	conf := &socks5.Config{
 		Logger:   l,
-		Resolver: resolver,
-	}
-	d := net.Dialer{
-		LocalAddr: proxyAddr,
-		Control:   controlFreebind,
+		Resolver: newResolver(getIPNetwork(&proxyIP)),
+		Rules:    ruleSet{},
 	}
+	d := newDialer(proxyAddr)
 	conf.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		v("%s proxy request for: %q", network, addr)
-		return d.DialContext(ctx, network, addr)
-	}
-	server, err := socks5.New(conf)
-	if err != nil {
-		return err
+		logRequest(ctx, "proxy request", network, addr, proxyIP.String())
+		return dial(ctx, proxyIP.String(), d, network, addr)
 	}
-	return server.ListenAndServe(proxyAddr.Network(), listenAddr)
+	return serve(conf, listenAddr)
 }
 
-// runRandomProxy starts a proxy listening on listenAddr that egresses every connection on a new random port in cider
-func runRandomProxy(cidr *net.IPNet, listenAddr string) error {
+// runRandomProxy starts a proxy listening on listenAddr that egresses every connection on a new IP returned by pick
+// pick is passed the destination IP so it can choose an address of the same family
+func runRandomProxy(pick func(dest net.IP) net.IP, listenAddr string) error {
 	conf := &socks5.Config{
 		Logger:   l,
 		Resolver: resolver,
+		Rules:    ruleSet{},
 	}
 	conf.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		ip := randomIP(cidr)
-		v("random %s proxy (%q) request for: %q", network, ip.String(), addr)
-		d := net.Dialer{
-			LocalAddr: &net.TCPAddr{
-				IP: ip,
-			},
-			Control: controlFreebind,
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
 		}
-		return d.DialContext(ctx, network, addr)
+		dest := net.ParseIP(host)
+		if gw := pickGateway(dest); gw != nil {
+			logRequest(ctx, "random proxy request", network, addr, "gateway "+gw.addr)
+			conn, err := gw.dial(ctx, addr)
+			return wrapConn(ctx, "gateway "+gw.addr, addr, conn, err)
+		}
+		ip := pick(dest)
+		logRequest(ctx, "random proxy request", network, addr, ip.String())
+		d := newDialer(&net.TCPAddr{
+			IP: ip,
+		})
+		return dial(ctx, ip.String(), d, network, addr)
 	}
+	return serve(conf, listenAddr)
+}
+
+// logRequest logs a proxied request with its client, destination and egress as fields
+func logRequest(ctx context.Context, msg, network, addr, egress string) {
+	client := ""
+	if req, ok := ctx.Value(requestKey{}).(*socks5.Request); ok && req.RemoteAddr != nil {
+		client = net.JoinHostPort(req.RemoteAddr.IP.String(), strconv.Itoa(req.RemoteAddr.Port))
+	}
+	vFields(msg, "network", network, "client", client, "dest", addr, "egress", egress)
+}
+
+// serve runs a SOCKS server with conf on listenAddr, recording its state for /readyz
+func serve(conf *socks5.Config, listenAddr string) error {
 	server, err := socks5.New(conf)
+	if err != nil {
+		setListener(listenAddr, err)
+		return err
+	}
+	ln, err := listen("tcp", listenAddr)
 	if err != nil {
 		return err
 	}
-	return server.ListenAndServe("tcp", listenAddr)
+	err = server.Serve(ln)
+	stopped(listenAddr, err)
+	return err
+}
+
+// newDialer returns a dialer bound to localAddr using the configured socket options
+func newDialer(localAddr net.Addr) *net.Dialer {
+	d := &net.Dialer{
+		LocalAddr: localAddr,
+		Control:   control,
+		Timeout:   *dialTimeout,
+		KeepAlive: *keepAlive,
+	}
+	setMPTCP(d)
+	return d
+}
+
+// dial connects to addr with d for a request egressing on egress, wrapping the connection as wrapConn does
+func dial(ctx context.Context, egress string, d *net.Dialer, network, addr string) (net.Conn, error) {
+	conn, err := connect(ctx, d, network, addr)
+	return wrapConn(ctx, egress, addr, conn, err)
+}
+
+// connect connects to addr with d and applies the TCP options that can only be set on an open connection
+func connect(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	for attempt := 1; ; attempt++ {
+		dd := d
+		if sourcePorts.max != 0 {
+			dd = withSourcePort(d, sourcePorts.random())
+		}
+		conn, err = inNetns(func() (net.Conn, error) {
+			return dd.DialContext(ctx, network, addr)
+		})
+		if err == nil || sourcePorts.max == 0 || attempt >= sourcePortAttempts || !sourcePortInUse(err) {
+			break
+		}
+		v("source port in use, retrying: %s", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		err = tcpConn.SetNoDelay(*noDelay)
+		if err == nil && *linger >= 0 {
+			err = tcpConn.SetLinger(*linger)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
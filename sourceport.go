@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sourcePortAttempts is how many random source ports are tried before giving up on a connection
+const sourcePortAttempts = 8
+
+// portRange is a flag.Value holding an inclusive range of ports
+type portRange struct {
+	min, max uint16
+}
+
+// String returns the range in the form accepted by Set
+func (r *portRange) String() string {
+	if r.max == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+// Set parses a range of the form "min-max" or a single port
+func (r *portRange) Set(s string) error {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	min, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return err
+	}
+	max, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return err
+	}
+	if min == 0 || min > max {
+		return fmt.Errorf("invalid port range %q", s)
+	}
+	r.min, r.max = uint16(min), uint16(max)
+	return nil
+}
+
+// random returns a random port within the range
+func (r *portRange) random() int {
+	return int(r.min) + rand.Intn(int(r.max)-int(r.min)+1)
+}
+
+// withSourcePort returns a copy of d bound to port on the same local IP
+func withSourcePort(d *net.Dialer, port int) *net.Dialer {
+	dd := *d
+	local := &net.TCPAddr{Port: port}
+	if addr, ok := d.LocalAddr.(*net.TCPAddr); ok {
+		local.IP = addr.IP
+	}
+	dd.LocalAddr = local
+	return &dd
+}
+
+// sourcePortInUse returns true if err was caused by the chosen source port already being taken
+func sourcePortInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxEgressStats bounds the number of egress addresses tracked, the least recently used are dropped first
+const maxEgressStats = 10000
+
+// egressStats are the counters of one egress address or gateway
+// the counters are first to keep them 64-bit aligned for atomic access
+type egressStats struct {
+	Active      int64     `json:"active"`
+	Connections uint64    `json:"connections"`
+	Failures    uint64    `json:"failures"`
+	BytesUp     uint64    `json:"bytes_up"`
+	BytesDown   uint64    `json:"bytes_down"`
+	Egress      string    `json:"egress"`
+	LastUsed    time.Time `json:"last_used"`
+}
+
+var (
+	statsMu     sync.Mutex
+	egressTotal = make(map[string]*egressStats)
+)
+
+// statsEnabled returns true if egress statistics are collected, only done for the admin API which reports them
+func statsEnabled() bool {
+	return *adminListen != ""
+}
+
+// egressCounters returns the statistics of egress marked as used now, nil if statistics are disabled
+func egressCounters(egress string) *egressStats {
+	if !statsEnabled() {
+		return nil
+	}
+	statsMu.Lock()
+	s, ok := egressTotal[egress]
+	if !ok {
+		if len(egressTotal) >= maxEgressStats {
+			evictEgressStats()
+		}
+		s = &egressStats{Egress: egress}
+		egressTotal[egress] = s
+	}
+	s.LastUsed = time.Now()
+	statsMu.Unlock()
+	return s
+}
+
+// evictEgressStats drops the least recently used tenth of the tracked addresses
+// statsMu must be held
+func evictEgressStats() {
+	all := make([]*egressStats, 0, len(egressTotal))
+	for _, s := range egressTotal {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].LastUsed.Before(all[j].LastUsed)
+	})
+	for _, s := range all[:len(all)/10+1] {
+		delete(egressTotal, s.Egress)
+	}
+}
+
+// snapshotEgressStats returns a copy of the statistics of every tracked egress
+func snapshotEgressStats() []egressStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	all := make([]egressStats, 0, len(egressTotal))
+	for _, s := range egressTotal {
+		all = append(all, egressStats{
+			Active:      atomic.LoadInt64(&s.Active),
+			Connections: atomic.LoadUint64(&s.Connections),
+			Failures:    atomic.LoadUint64(&s.Failures),
+			BytesUp:     atomic.LoadUint64(&s.BytesUp),
+			BytesDown:   atomic.LoadUint64(&s.BytesDown),
+			Egress:      s.Egress,
+			LastUsed:    s.LastUsed,
+		})
+	}
+	return all
+}
+
+// groupEgressStats sums the statistics of egress addresses in the same prefix of the given length
+// gateways and addresses shorter than the prefix are left as they are
+func groupEgressStats(all []egressStats, bits4, bits6 int) []egressStats {
+	groups := make(map[string]*egressStats)
+	for _, s := range all {
+		key := s.Egress
+		if ip := net.ParseIP(s.Egress); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				key = (&net.IPNet{IP: ip4.Mask(net.CIDRMask(bits4, 32)), Mask: net.CIDRMask(bits4, 32)}).String()
+			} else {
+				key = (&net.IPNet{IP: ip.Mask(net.CIDRMask(bits6, 128)), Mask: net.CIDRMask(bits6, 128)}).String()
+			}
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &egressStats{Egress: key}
+			groups[key] = g
+		}
+		g.Active += s.Active
+		g.Connections += s.Connections
+		g.Failures += s.Failures
+		g.BytesUp += s.BytesUp
+		g.BytesDown += s.BytesDown
+		if s.LastUsed.After(g.LastUsed) {
+			g.LastUsed = s.LastUsed
+		}
+	}
+	grouped := make([]egressStats, 0, len(groups))
+	for _, g := range groups {
+		grouped = append(grouped, *g)
+	}
+	return grouped
+}